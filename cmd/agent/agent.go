@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"github.com/eugeniylennik/alertics/internal/client"
+	"github.com/eugeniylennik/alertics/internal/collector"
 	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/spool"
 	"log"
 	"os"
 	"os/signal"
@@ -11,9 +13,10 @@ import (
 	"time"
 )
 
-var cfg = client.InitConfigAgent()
+var cfg *client.Agent
 
 func main() {
+	cfg = client.InitConfigAgent()
 	ctx, cancel := context.WithCancel(context.Background())
 
 	c, err := client.NewHTTPClient(cfg)
@@ -21,10 +24,27 @@ func main() {
 		log.Fatal(err)
 	}
 
+	r := collector.NewDefaultRegistry()
+	r.MustRegister(c)
+	collectors, err := r.Configure(cfg.Collectors, cfg.PoolInterval)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	q, err := spool.Open(cfg.SpoolDir, cfg.SpoolMaxSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	ch := make(chan []metrics.Data)
+	done := make(chan struct{})
 
-	go collectMetrics(ctx, ch)
-	go sendMetrics(ctx, c, ch)
+	go func() {
+		if err := r.Run(ctx, collectors, cfg.CollectTimeout, ch); err != nil {
+			log.Fatal(err)
+		}
+	}()
+	go sendMetrics(ctx, c, q, ch, done)
 
 	s := make(chan os.Signal, 1)
 	signal.Notify(s, syscall.SIGINT, syscall.SIGTERM)
@@ -34,38 +54,127 @@ func main() {
 		cancel()
 	case <-ctx.Done():
 	}
+	// Wait for the unsent metrics to be spooled.
+	<-done
+	if err := c.Close(); err != nil {
+		log.Println(err)
+	}
 }
 
-func collectMetrics(ctx context.Context, ch chan []metrics.Data) {
-	tPool := time.NewTicker(cfg.PoolInterval)
-	defer tPool.Stop()
+// maxReplayDelay caps the backoff between attempts to replay the spool.
+const maxReplayDelay = 5 * time.Minute
 
-	for {
-		select {
-		case <-tPool.C:
-			ch <- metrics.CollectMetrics()
-		case <-ctx.Done():
-			return
-		}
-	}
-}
+func sendMetrics(ctx context.Context, c *client.Client, q *spool.Queue, ch chan []metrics.Data, done chan struct{}) {
+	defer close(done)
 
-func sendMetrics(ctx context.Context, c *client.Client, ch chan []metrics.Data) {
 	tReport := time.NewTicker(cfg.ReportInterval)
 	defer tReport.Stop()
 
-	var m []metrics.Data
+	acc := metrics.NewAccumulator()
+	delay := cfg.ReportInterval
+	var retryAt time.Time
 	for {
 		select {
 		case newM := <-ch:
-			m = newM
+			acc.Add(newM)
 		case <-tReport.C:
-			if err := c.SendMetricsBatch(m); err != nil {
-				log.Fatal(err)
+			batch := c.Stamp(acc.Snapshot())
+
+			// Once batches are spooled, new ones queue up behind them so the
+			// server receives every batch in order. Metrics are acknowledged,
+			// and so reset in the accumulator, once the server has stored
+			// them, rejected them for good or they are spooled for replay;
+			// the rest is kept for the next report.
+			var err error
+			if q.Len() == 0 {
+				err = c.SendMetricsBatch(ctx, batch)
+				logRejected(err, batch)
+				if unsent := client.Unsent(err, batch); spoolBatch(q, unsent) {
+					acc.Ack(batch)
+				} else {
+					acc.Ack(except(batch, unsent))
+				}
+			} else {
+				if spoolBatch(q, batch) {
+					acc.Ack(batch)
+				}
+				if time.Now().Before(retryAt) {
+					continue
+				}
+				err = replay(ctx, c, q)
+			}
+
+			if err != nil {
+				log.Printf("failed to send metrics, %d batches spooled: %v\n", q.Len(), err)
+				retryAt = time.Now().Add(delay)
+				if delay *= 2; delay > maxReplayDelay {
+					delay = maxReplayDelay
+				}
+				continue
 			}
-			m = nil
+			delay = cfg.ReportInterval
 		case <-ctx.Done():
+			spoolBatch(q, acc.Snapshot())
 			return
 		}
 	}
 }
+
+// replay sends the spooled batches oldest first and stops at the first
+// failure that may be retried. Batches the server rejects for good are
+// dropped, so they do not hold up the ones queued behind them.
+func replay(ctx context.Context, c *client.Client, q *spool.Queue) error {
+	for {
+		batch, ok, err := q.Peek()
+		if err != nil || !ok {
+			return err
+		}
+		if err := c.SendMetricsBatch(ctx, batch); err != nil {
+			logRejected(err, batch)
+			// Keep only the part that may still be delivered.
+			unsent := client.Unsent(err, batch)
+			if len(unsent) < len(batch) {
+				if err := q.ReplaceOldest(unsent); err != nil {
+					return err
+				}
+			}
+			if len(unsent) > 0 {
+				return err
+			}
+			continue
+		}
+		if err := q.Pop(); err != nil {
+			return err
+		}
+	}
+}
+
+// except returns the metrics of batch that are not in sub.
+func except(batch, sub []metrics.Data) []metrics.Data {
+	skip := map[string]bool{}
+	for _, v := range sub {
+		skip[v.Type+":"+v.Name] = true
+	}
+	var result []metrics.Data
+	for _, v := range batch {
+		if !skip[v.Type+":"+v.Name] {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// logRejected logs the metrics of batch the server refused for good.
+func logRejected(err error, batch []metrics.Data) {
+	if rejected := client.Rejected(err, batch); len(rejected) > 0 {
+		log.Printf("dropping %d metrics rejected by the server: %v\n", len(rejected), err)
+	}
+}
+
+func spoolBatch(q *spool.Queue, batch []metrics.Data) bool {
+	if err := q.Push(batch); err != nil {
+		log.Printf("failed to spool %d metrics: %v\n", len(batch), err)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/client"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/spool"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newRejectingClient returns a client of a server that rejects every request
+// and the number of requests it received.
+func newRejectingClient(t *testing.T) (*client.Client, *int64) {
+	var requests int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	t.Cleanup(ts.Close)
+
+	c, err := client.NewHTTPClient(&client.Agent{
+		Address:          strings.TrimPrefix(ts.URL, "http://"),
+		RetryMaxAttempts: 3,
+		BatchSize:        10,
+	})
+	require.NoError(t, err)
+	return c, &requests
+}
+
+func TestReplay_DropsRejectedBatches(t *testing.T) {
+	c, requests := newRejectingClient(t)
+	q, err := spool.Open(t.TempDir(), 0)
+	require.NoError(t, err)
+	require.NoError(t, q.Push([]metrics.Data{{Name: "PollCount", Type: "counter", Value: 1}}))
+	require.NoError(t, q.Push([]metrics.Data{{Name: "PollCount", Type: "counter", Value: 2}}))
+
+	require.NoError(t, replay(context.Background(), c, q))
+	assert.Equal(t, 0, q.Len())
+	assert.Equal(t, int64(2), atomic.LoadInt64(requests))
+}
+
+func TestSendMetrics_DoesNotSpoolRejectedBatches(t *testing.T) {
+	c, requests := newRejectingClient(t)
+	q, err := spool.Open(t.TempDir(), 0)
+	require.NoError(t, err)
+	cfg = &client.Agent{ReportInterval: 10 * time.Millisecond}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan []metrics.Data)
+	done := make(chan struct{})
+	go sendMetrics(ctx, c, q, ch, done)
+
+	ch <- []metrics.Data{{Name: "PollCount", Type: "counter", Value: 1}}
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(requests) > 0
+	}, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, 0, q.Len())
+}
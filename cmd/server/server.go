@@ -2,12 +2,21 @@ package main
 
 import (
 	"context"
+	"github.com/eugeniylennik/alertics/internal/alerting"
 	"github.com/eugeniylennik/alertics/internal/database"
+	"github.com/eugeniylennik/alertics/internal/encryption"
 	"github.com/eugeniylennik/alertics/internal/router"
+	"github.com/eugeniylennik/alertics/internal/rpc"
 	"github.com/eugeniylennik/alertics/internal/server"
 	"github.com/eugeniylennik/alertics/internal/storage"
+	dbstorage "github.com/eugeniylennik/alertics/internal/storage/database"
 	"github.com/eugeniylennik/alertics/internal/storage/file"
+	"github.com/eugeniylennik/alertics/internal/storage/sqlite"
+	"github.com/eugeniylennik/alertics/internal/telemetry"
+	"github.com/eugeniylennik/alertics/internal/tlsconfig"
+	"google.golang.org/grpc"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -18,28 +27,90 @@ import (
 var cfg = server.InitConfigServer()
 
 func main() {
-	store := storage.NewMemStorage(cfg.StoreFile, cfg.StoreInterval == 0)
+	ctx, cancel := context.WithCancel(context.Background())
 
-	client, err := database.NewClient(context.TODO(), 5, cfg.Dsn)
+	store, err := newRepository(ctx)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	r := router.NewRouter(store, client)
+	repo := telemetry.InstrumentRepository(store)
+
+	opts := []router.Option{
+		router.WithMaxDecompressedSize(cfg.MaxDecompressedSize),
+		router.WithKey(cfg.Key),
+		router.WithSignatureMaxSkew(cfg.SignatureMaxSkew),
+		router.WithRequireCanonicalSignatures(cfg.RequireCanonical),
+	}
+	if cfg.CryptoKey != "" {
+		key, err := encryption.LoadPrivateKey(cfg.CryptoKey)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, router.WithPrivateKey(key))
+	}
+	var subnet *net.IPNet
+	if cfg.TrustedSubnet != "" {
+		if _, subnet, err = net.ParseCIDR(cfg.TrustedSubnet); err != nil {
+			log.Fatalln(err)
+		}
+		opts = append(opts, router.WithTrustedSubnet(subnet))
+	}
+	engine, err := newAlertingEngine(repo)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	if engine != nil {
+		opts = append(opts, router.WithAlerting(engine))
+	}
+
+	r := router.NewRouter(repo, opts...)
 
 	s := &http.Server{
 		Addr:    cfg.Address,
 		Handler: r,
 	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		if s.TLSConfig, err = tlsconfig.Server(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA); err != nil {
+			log.Fatalln(err)
+		}
+	} else if cfg.TLSClientCA != "" {
+		log.Fatalln("client CA requires a TLS certificate")
+	}
+
+	var gs *grpc.Server
+	if cfg.GRPCAddress != "" {
+		rpcOpts := []rpc.Option{
+			rpc.WithKey(cfg.Key),
+			rpc.WithSignatureMaxSkew(cfg.SignatureMaxSkew),
+			rpc.WithRequireCanonicalSignatures(cfg.RequireCanonical),
+			rpc.WithTrustedSubnet(subnet),
+		}
+		if s.TLSConfig != nil {
+			rpcOpts = append(rpcOpts, rpc.WithTLS(s.TLSConfig))
+		}
+		gs = rpc.NewServer(repo, rpcOpts...)
+	}
 
 	errChan := make(chan error, 1)
-	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
-		if err := restoreMetrics(store); err != nil {
+		if err := restoreMetrics(ctx, store); err != nil {
 			log.Println(err)
 		}
-		if err := s.ListenAndServe(); err != http.ErrServerClosed {
+		if gs != nil {
+			go func() {
+				if err := serveGRPC(gs); err != nil {
+					errChan <- err
+				}
+			}()
+		}
+		// The certificate is already loaded into TLSConfig.
+		serve := s.ListenAndServe
+		if s.TLSConfig != nil {
+			serve = func() error { return s.ListenAndServeTLS("", "") }
+		}
+		if err := serve(); err != http.ErrServerClosed {
 			errChan <- err
 		}
 	}()
@@ -50,6 +121,44 @@ func main() {
 		}
 	}()
 
+	go func() {
+		if err := compactHistory(ctx, store); err != nil {
+			errChan <- err
+		}
+	}()
+
+	if engine != nil {
+		go func() {
+			if err := engine.Run(ctx, cfg.EvalInterval); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+
+	if engine != nil && len(cfg.WebhookURLs) > 0 {
+		notifier := alerting.NewNotifier(alerting.NotifierConfig{
+			URLs:           cfg.WebhookURLs,
+			GroupBy:        cfg.GroupBy,
+			GroupWait:      cfg.GroupWait,
+			RepeatInterval: cfg.RepeatInterval,
+			MaxAttempts:    cfg.WebhookAttempts,
+			BaseDelay:      time.Second,
+			MaxDelay:       time.Minute,
+		})
+		source := engine.Alerts
+		if silences, ok := store.(storage.SilenceRepository); ok {
+			silencer := alerting.NewSilencer(silences)
+			source = func() []alerting.Alert {
+				return silencer.Apply(ctx, engine.Alerts())
+			}
+		}
+		go func() {
+			if err := notifier.Run(ctx, source, time.Second); err != nil {
+				errChan <- err
+			}
+		}()
+	}
+
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
 
@@ -59,6 +168,9 @@ func main() {
 		cancel()
 		return
 	case <-sig:
+		if gs != nil {
+			gs.GracefulStop()
+		}
 		s.SetKeepAlivesEnabled(false)
 		if err := s.Shutdown(ctx); err != nil {
 			log.Printf("HTTP server shutdown error: %v\n", err)
@@ -66,55 +178,138 @@ func main() {
 		} else {
 			log.Printf("HTTP server gracefully stopped\n")
 		}
+		if fs, ok := store.(*file.Storage); ok {
+			if err := fs.Flush(ctx); err != nil {
+				log.Printf("failed to flush metrics to file: %v\n", err)
+			}
+		}
+		cancel()
 	}
 }
 
-func collectMetricsToFile(ctx context.Context, store *storage.MemStorage) error {
-	if cfg.StoreInterval != 0 && cfg.Dsn != "" {
-		interval := time.NewTicker(cfg.StoreInterval)
-		defer interval.Stop()
+func serveGRPC(gs *grpc.Server) error {
+	l, err := net.Listen("tcp", cfg.GRPCAddress)
+	if err != nil {
+		return err
+	}
+	return gs.Serve(l)
+}
 
-		w, err := file.NewWriter(cfg.StoreFile)
+// newRepository picks the storage backend once at startup: SQLite for a
+// sqlite:// DSN, Postgres for any other DSN, the file storage when a store
+// file is set and plain memory otherwise.
+func newRepository(ctx context.Context) (storage.Repository, error) {
+	switch {
+	case database.IsSQLiteDSN(cfg.Dsn):
+		db, err := database.NewSQLiteClient(ctx, cfg.Dsn)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return sqlite.NewStorage(db), nil
+	case cfg.Dsn != "":
+		client, err := database.NewClient(ctx, 5, cfg.Dsn)
+		if err != nil {
+			return nil, err
+		}
+		return dbstorage.NewStorage(client), nil
+	case cfg.StoreFile != "":
+		return file.NewStorage(cfg.StoreFile, cfg.StoreInterval == 0, historySize())
+	default:
+		return storage.NewMemStorage(historySize()), nil
+	}
+}
 
-		for {
-			select {
-			case <-interval.C:
-				mBz, err := store.GetAllMetrics()
-				if err != nil {
-					return err
-				}
-				if err := w.WriteMetrics(mBz); err != nil {
-					return err
-				}
-			case <-ctx.Done():
-				return nil
+// historySize is the configured history size or the one covering the raw
+// retention.
+func historySize() int {
+	if cfg.HistorySize > 0 {
+		return cfg.HistorySize
+	}
+	policy, err := storage.ParseRetentionPolicy(cfg.Retention)
+	if err != nil {
+		return storage.DefaultHistorySize
+	}
+	return storage.HistorySize(policy.Raw)
+}
+
+func collectMetricsToFile(ctx context.Context, store storage.Repository) error {
+	fs, ok := store.(*file.Storage)
+	if !ok || cfg.StoreInterval == 0 {
+		return nil
+	}
+
+	interval := time.NewTicker(cfg.StoreInterval)
+	defer interval.Stop()
+
+	for {
+		select {
+		case <-interval.C:
+			start := time.Now()
+			err := fs.Flush(ctx)
+			telemetry.FileDumpDuration.Observe(time.Since(start).Seconds())
+			if err != nil {
+				return err
 			}
+		case <-ctx.Done():
+			return nil
 		}
 	}
-	return nil
 }
 
-func restoreMetrics(store *storage.MemStorage) error {
-	if cfg.Restore {
-		r, err := file.NewReader(cfg.StoreFile)
-		if err != nil {
-			return err
-		}
-		m, err := r.ReadMetrics()
-		if err != nil {
-			return err
-		}
-		for _, v := range m {
-			switch v.Type {
-			case storage.Gauge:
-				_ = store.AddGauge(v)
-			case storage.Counter:
-				_ = store.AddCounter(v)
+// newAlertingEngine loads the alert rules and their saved state. It returns a
+// nil engine when no rules file is configured.
+func newAlertingEngine(store storage.Repository) (*alerting.Engine, error) {
+	if cfg.RulesFile == "" {
+		return nil, nil
+	}
+	rules, err := alerting.LoadRules(cfg.RulesFile)
+	if err != nil {
+		return nil, err
+	}
+	engine := alerting.NewEngine(store, rules, cfg.AlertsStateFile)
+	if err := engine.Restore(); err != nil {
+		log.Printf("failed to restore alerts state: %v\n", err)
+	}
+	return engine, nil
+}
+
+// compactHistory periodically downsamples stored history and drops data past
+// the configured retention on backends that support it.
+func compactHistory(ctx context.Context, store storage.Repository) error {
+	if cfg.CompactInterval == 0 {
+		return nil
+	}
+	rs, ok := store.(storage.RollupStore)
+	if !ok {
+		log.Printf("storage %T does not support retention, history is kept forever\n", store)
+		return nil
+	}
+
+	policy, err := storage.ParseRetentionPolicy(cfg.Retention)
+	if err != nil {
+		return err
+	}
+
+	compactor := storage.NewCompactor(rs, policy)
+	interval := time.NewTicker(cfg.CompactInterval)
+	defer interval.Stop()
+
+	for {
+		select {
+		case <-interval.C:
+			if err := compactor.Compact(ctx, time.Now()); err != nil {
+				log.Printf("failed to compact history: %v\n", err)
 			}
+		case <-ctx.Done():
+			return nil
 		}
 	}
-	return nil
+}
+
+func restoreMetrics(ctx context.Context, store storage.Repository) error {
+	fs, ok := store.(*file.Storage)
+	if !ok || !cfg.Restore {
+		return nil
+	}
+	return fs.Restore(ctx)
 }
@@ -0,0 +1,324 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+// resolvedRetention is how long resolved alerts are kept before being dropped.
+const resolvedRetention = 15 * time.Minute
+
+var ErrAlertNotFound = errors.New("alert not found")
+
+// Alert is the state of a rule for one series. Labels hold the labels of the
+// series together with the rule labels, which take precedence.
+type Alert struct {
+	Rule        string            `json:"rule"`
+	Metric      string            `json:"metric"`
+	MType       string            `json:"type"`
+	Series      metrics.Labels    `json:"series,omitempty"`
+	State       State             `json:"state"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Value       float64           `json:"value"`
+	ActiveAt    time.Time         `json:"active_at"`
+	FiredAt     time.Time         `json:"fired_at,omitempty"`
+	ResolvedAt  time.Time         `json:"resolved_at,omitempty"`
+	// Acknowledgement is cleared when the alert resolves.
+	Acknowledgement *Acknowledgement `json:"acknowledgement,omitempty"`
+	// SilencedBy holds the ids of the active silences matching the alert.
+	// It is filled in by Silencer and never persisted.
+	SilencedBy []string `json:"silenced_by,omitempty"`
+}
+
+// Key identifies the alert by its rule and series.
+func (a Alert) Key() string {
+	return a.Rule + a.Series.String()
+}
+
+type Acknowledgement struct {
+	Author  string    `json:"author"`
+	Comment string    `json:"comment"`
+	At      time.Time `json:"at"`
+}
+
+// Engine evaluates rules against the storage and tracks the state of the
+// alerts they produce. The state is saved to stateFile after every evaluation
+// so pending and firing alerts survive restarts.
+type Engine struct {
+	mux       sync.RWMutex
+	repo      storage.Repository
+	rules     []Rule
+	alerts    map[string]*Alert
+	stateFile string
+	now       func() time.Time
+}
+
+func NewEngine(repo storage.Repository, rules []Rule, stateFile string) *Engine {
+	return &Engine{
+		repo:      repo,
+		rules:     rules,
+		alerts:    map[string]*Alert{},
+		stateFile: stateFile,
+		now:       time.Now,
+	}
+}
+
+// Run evaluates the rules every interval until ctx is done.
+func (e *Engine) Run(ctx context.Context, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			if err := e.Evaluate(ctx); err != nil {
+				log.Printf("failed to evaluate alert rules: %v\n", err)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Evaluate runs every rule once for each matching series and saves the
+// resulting state. Alerts of series that no longer exist are treated as
+// inactive.
+func (e *Engine) Evaluate(ctx context.Context) error {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	all, err := e.repo.ListMetrics(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := e.now()
+	for _, r := range e.rules {
+		seen := map[string]bool{}
+		for _, m := range storage.FilterMetrics(all, r.Matchers) {
+			if m.MType != r.MType || m.ID != r.Metric {
+				continue
+			}
+			value := storage.NewSample(now, m).Value
+			key := e.apply(r, m.Labels, r.Matches(value), value, now)
+			seen[key] = true
+		}
+		for key, a := range e.alerts {
+			if a.Rule == r.Name && !seen[key] {
+				e.apply(r, a.Series, false, 0, now)
+			}
+		}
+	}
+
+	return e.save()
+}
+
+// apply updates the alert of rule r for the series with the given labels and
+// returns its key.
+func (e *Engine) apply(r Rule, series metrics.Labels, active bool, value float64, now time.Time) string {
+	key := Alert{Rule: r.Name, Series: series}.Key()
+	a, ok := e.alerts[key]
+
+	if !active {
+		switch {
+		case !ok:
+		case a.State == StatePending:
+			delete(e.alerts, key)
+		case a.State == StateFiring:
+			a.State = StateResolved
+			a.ResolvedAt = now
+			a.Acknowledgement = nil
+		case a.State == StateResolved && now.Sub(a.ResolvedAt) >= resolvedRetention:
+			delete(e.alerts, key)
+		}
+		return key
+	}
+
+	if !ok || a.State == StateResolved {
+		a = &Alert{
+			Rule:        r.Name,
+			Metric:      r.Metric,
+			MType:       r.MType,
+			Series:      series,
+			State:       StatePending,
+			Labels:      metrics.Labels(r.Labels).Merge(series),
+			Annotations: r.Annotations,
+			ActiveAt:    now,
+		}
+		e.alerts[key] = a
+	}
+	a.Value = value
+	if a.State == StatePending && now.Sub(a.ActiveAt) >= r.For {
+		a.State = StateFiring
+		a.FiredAt = now
+	}
+	return key
+}
+
+// Alerts returns a snapshot of the pending, firing and recently resolved
+// alerts ordered by rule name and series.
+func (e *Engine) Alerts() []Alert {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	result := make([]Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		result = append(result, *a)
+	}
+	sortAlerts(result)
+	return result
+}
+
+// Acknowledge marks the pending or firing alerts of rule whose series match
+// series as handled by author. Nil series selects every alert of rule.
+func (e *Engine) Acknowledge(rule string, series metrics.Labels, author, comment string) ([]Alert, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	ack := &Acknowledgement{Author: author, Comment: comment, At: e.now()}
+	result := e.update(rule, series, func(a *Alert) bool {
+		if a.State == StateResolved {
+			return false
+		}
+		a.Acknowledgement = ack
+		return true
+	})
+	if len(result) == 0 {
+		return nil, ErrAlertNotFound
+	}
+	return result, e.save()
+}
+
+// Unacknowledge removes the acknowledgement of the alerts of rule whose
+// series match series.
+func (e *Engine) Unacknowledge(rule string, series metrics.Labels) ([]Alert, error) {
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	result := e.update(rule, series, func(a *Alert) bool {
+		a.Acknowledgement = nil
+		return true
+	})
+	if len(result) == 0 {
+		return nil, ErrAlertNotFound
+	}
+	return result, e.save()
+}
+
+// update calls fn for the alerts of rule whose series match series and
+// returns those for which it reports true.
+func (e *Engine) update(rule string, series metrics.Labels, fn func(a *Alert) bool) []Alert {
+	var result []Alert
+	for _, a := range e.alerts {
+		if a.Rule == rule && a.Series.Matches(series) && fn(a) {
+			result = append(result, *a)
+		}
+	}
+	sortAlerts(result)
+	return result
+}
+
+func sortAlerts(alerts []Alert) {
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Rule != alerts[j].Rule {
+			return alerts[i].Rule < alerts[j].Rule
+		}
+		return alerts[i].Series.String() < alerts[j].Series.String()
+	})
+}
+
+// RuleStatus is a rule together with the current alerts of its series.
+type RuleStatus struct {
+	Rule
+	Alerts []Alert `json:"alerts,omitempty"`
+}
+
+func (e *Engine) Rules() []RuleStatus {
+	e.mux.RLock()
+	defer e.mux.RUnlock()
+
+	result := make([]RuleStatus, 0, len(e.rules))
+	for _, r := range e.rules {
+		s := RuleStatus{Rule: r}
+		for _, a := range e.alerts {
+			if a.Rule == r.Name {
+				s.Alerts = append(s.Alerts, *a)
+			}
+		}
+		sortAlerts(s.Alerts)
+		result = append(result, s)
+	}
+	return result
+}
+
+// Restore loads the alert state saved by a previous run. Alerts of rules that
+// no longer exist are dropped.
+func (e *Engine) Restore() error {
+	if e.stateFile == "" {
+		return nil
+	}
+	b, err := os.ReadFile(e.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var alerts []*Alert
+	if err := json.Unmarshal(b, &alerts); err != nil {
+		return err
+	}
+
+	e.mux.Lock()
+	defer e.mux.Unlock()
+
+	rules := map[string]bool{}
+	for _, r := range e.rules {
+		rules[r.Name] = true
+	}
+	for _, a := range alerts {
+		if rules[a.Rule] {
+			e.alerts[a.Key()] = a
+		}
+	}
+	return nil
+}
+
+func (e *Engine) save() error {
+	if e.stateFile == "" {
+		return nil
+	}
+	alerts := make([]*Alert, 0, len(e.alerts))
+	for _, a := range e.alerts {
+		alerts = append(alerts, a)
+	}
+	b, err := json.Marshal(alerts)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn state.
+	tmp := e.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, e.stateFile)
+}
@@ -0,0 +1,140 @@
+package alerting
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadRules(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rules.yml")
+	require.NoError(t, os.WriteFile(fileName, []byte(`
+rules:
+  - name: HighHeapUsage
+    metric: HeapAlloc
+    type: gauge
+    op: ">"
+    threshold: 100
+    for: 1m
+    labels:
+      severity: warning
+`), 0644))
+
+	rules, err := LoadRules(fileName)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, time.Minute, rules[0].For)
+	assert.Equal(t, "warning", rules[0].Labels["severity"])
+
+	require.NoError(t, os.WriteFile(fileName, []byte(`
+rules:
+  - name: Broken
+    metric: HeapAlloc
+    type: gauge
+    op: "~"
+`), 0644))
+	_, err = LoadRules(fileName)
+	assert.Error(t, err)
+}
+
+func TestEngine_Evaluate(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	stateFile := filepath.Join(t.TempDir(), "alerts.json")
+	rules := []Rule{{Name: "HighHeapUsage", Metric: "HeapAlloc", MType: storage.Gauge, Op: ">", Threshold: 100, For: time.Minute}}
+
+	now := time.Now()
+	e := NewEngine(repo, rules, stateFile)
+	e.now = func() time.Time { return now }
+
+	setGauge := func(v float64) {
+		_, err := repo.UpsertMetric(ctx, metrics.Metrics{ID: "HeapAlloc", MType: storage.Gauge, Value: &v})
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, e.Evaluate(ctx))
+	assert.Empty(t, e.Alerts())
+
+	setGauge(150)
+	require.NoError(t, e.Evaluate(ctx))
+	require.Len(t, e.Alerts(), 1)
+	assert.Equal(t, StatePending, e.Alerts()[0].State)
+
+	now = now.Add(time.Minute)
+	require.NoError(t, e.Evaluate(ctx))
+	assert.Equal(t, StateFiring, e.Alerts()[0].State)
+
+	restored := NewEngine(repo, rules, stateFile)
+	require.NoError(t, restored.Restore())
+	require.Len(t, restored.Alerts(), 1)
+	assert.Equal(t, StateFiring, restored.Alerts()[0].State)
+	assert.True(t, e.Alerts()[0].ActiveAt.Equal(restored.Alerts()[0].ActiveAt))
+
+	setGauge(50)
+	now = now.Add(time.Minute)
+	require.NoError(t, e.Evaluate(ctx))
+	assert.Equal(t, StateResolved, e.Alerts()[0].State)
+
+	now = now.Add(resolvedRetention)
+	require.NoError(t, e.Evaluate(ctx))
+	assert.Empty(t, e.Alerts())
+}
+
+func TestEngine_EvaluateLabeledSeries(t *testing.T) {
+	ctx := context.Background()
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	rules := []Rule{{
+		Name:      "HighHeapUsage",
+		Metric:    "HeapAlloc",
+		MType:     storage.Gauge,
+		Matchers:  metrics.Labels{"env": "prod"},
+		Op:        ">",
+		Threshold: 100,
+		Labels:    map[string]string{"severity": "warning"},
+	}}
+
+	now := time.Now()
+	e := NewEngine(repo, rules, filepath.Join(t.TempDir(), "alerts.json"))
+	e.now = func() time.Time { return now }
+
+	setGauge := func(v float64, labels metrics.Labels) {
+		_, err := repo.UpsertMetric(ctx, metrics.Metrics{ID: "HeapAlloc", MType: storage.Gauge, Value: &v, Labels: labels})
+		require.NoError(t, err)
+	}
+	setGauge(150, metrics.Labels{"host": "web-1", "env": "prod"})
+	setGauge(50, metrics.Labels{"host": "web-2", "env": "prod"})
+	setGauge(500, metrics.Labels{"host": "web-3", "env": "dev"})
+
+	require.NoError(t, e.Evaluate(ctx))
+	alerts := e.Alerts()
+	require.Len(t, alerts, 1)
+	assert.Equal(t, StateFiring, alerts[0].State)
+	assert.Equal(t, "web-1", alerts[0].Labels["host"])
+	assert.Equal(t, "warning", alerts[0].Labels["severity"])
+
+	setGauge(200, metrics.Labels{"host": "web-2", "env": "prod"})
+	require.NoError(t, e.Evaluate(ctx))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 2)
+	assert.Equal(t, "web-1", alerts[0].Series["host"])
+	assert.Equal(t, "web-2", alerts[1].Series["host"])
+
+	acked, err := e.Acknowledge("HighHeapUsage", metrics.Labels{"host": "web-2"}, "alice", "")
+	require.NoError(t, err)
+	require.Len(t, acked, 1)
+	assert.Equal(t, "web-2", acked[0].Series["host"])
+
+	setGauge(50, metrics.Labels{"host": "web-1", "env": "prod"})
+	require.NoError(t, e.Evaluate(ctx))
+	alerts = e.Alerts()
+	require.Len(t, alerts, 2)
+	assert.Equal(t, StateResolved, alerts[0].State)
+	assert.Equal(t, StateFiring, alerts[1].State)
+	assert.NotNil(t, alerts[1].Acknowledgement)
+}
@@ -0,0 +1,240 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/utils"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type NotifierConfig struct {
+	URLs []string
+	// GroupBy lists the labels alerts are grouped by. Without labels all
+	// alerts end up in a single group.
+	GroupBy []string
+	// GroupWait is how long changes to a group are collected before they are
+	// sent together.
+	GroupWait time.Duration
+	// RepeatInterval is how often unchanged firing alerts are sent again.
+	RepeatInterval time.Duration
+	MaxAttempts    int
+	BaseDelay      time.Duration
+	MaxDelay       time.Duration
+}
+
+// Payload is the JSON document posted to the webhooks.
+type Payload struct {
+	Status      string            `json:"status"`
+	GroupLabels map[string]string `json:"group_labels"`
+	Alerts      []Alert           `json:"alerts"`
+}
+
+type group struct {
+	labels    map[string]string
+	notified  map[string]State
+	changedAt time.Time
+	lastSent  time.Time
+}
+
+// Notifier delivers firing and resolved alerts to webhooks.
+type Notifier struct {
+	cfg    NotifierConfig
+	client *http.Client
+	mux    sync.Mutex
+	groups map[string]*group
+	wg     sync.WaitGroup
+	now    func() time.Time
+}
+
+func NewNotifier(cfg NotifierConfig) *Notifier {
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 1
+	}
+	return &Notifier{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+		groups: map[string]*group{},
+		now:    time.Now,
+	}
+}
+
+// Run checks the alerts returned by source every interval and sends the
+// groups that are due until ctx is done.
+func (n *Notifier) Run(ctx context.Context, source func() []Alert, interval time.Duration) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			n.Flush(ctx, source())
+		case <-ctx.Done():
+			n.wg.Wait()
+			return nil
+		}
+	}
+}
+
+// Flush sends the groups of alerts that changed at least GroupWait ago and
+// repeats the ones that kept firing for RepeatInterval. Pending alerts,
+// silenced firing alerts and resolved alerts that were never sent as firing
+// are skipped; acknowledged alerts are not repeated. Silenced alerts keep
+// their notified state, so an alert that was sent as firing before it was
+// silenced is still sent once it resolves.
+func (n *Notifier) Flush(ctx context.Context, alerts []Alert) {
+	n.mux.Lock()
+	defer n.mux.Unlock()
+
+	now := n.now()
+	current := map[string][]Alert{}
+	for _, a := range alerts {
+		if a.State == StatePending {
+			continue
+		}
+		key := n.groupKey(a)
+		current[key] = append(current[key], a)
+	}
+
+	for key, as := range current {
+		g, ok := n.groups[key]
+		if !ok {
+			g = &group{labels: n.groupLabels(as[0]), notified: map[string]State{}}
+			n.groups[key] = g
+		}
+
+		var send []Alert
+		changed, firing, unacknowledged := false, false, false
+		for _, a := range as {
+			prev, ok := g.notified[a.Key()]
+			if a.State == StateFiring && len(a.SilencedBy) > 0 {
+				continue
+			}
+			if a.State == StateResolved && prev != StateFiring {
+				continue
+			}
+			if !ok || prev != a.State {
+				changed = true
+			}
+			if a.State == StateFiring {
+				firing = true
+				if a.Acknowledgement == nil {
+					unacknowledged = true
+				}
+			}
+			send = append(send, a)
+		}
+		if len(send) == 0 {
+			continue
+		}
+
+		if changed && g.changedAt.IsZero() {
+			g.changedAt = now
+		}
+		due := changed && now.Sub(g.changedAt) >= n.cfg.GroupWait
+		repeat := !changed && unacknowledged && now.Sub(g.lastSent) >= n.cfg.RepeatInterval
+		if !due && !repeat {
+			continue
+		}
+
+		n.send(ctx, g, send, firing)
+		for _, a := range send {
+			if a.State == StateResolved {
+				delete(g.notified, a.Key())
+				continue
+			}
+			g.notified[a.Key()] = a.State
+		}
+		g.changedAt = time.Time{}
+		g.lastSent = now
+	}
+
+	for key, g := range n.groups {
+		alerts := map[string]bool{}
+		for _, a := range current[key] {
+			alerts[a.Key()] = true
+		}
+		for k := range g.notified {
+			if !alerts[k] {
+				delete(g.notified, k)
+			}
+		}
+		if len(g.notified) == 0 && len(current[key]) == 0 {
+			delete(n.groups, key)
+		}
+	}
+}
+
+func (n *Notifier) send(ctx context.Context, g *group, alerts []Alert, firing bool) {
+	p := Payload{Status: string(StateResolved), GroupLabels: g.labels, Alerts: alerts}
+	if firing {
+		p.Status = string(StateFiring)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		log.Printf("failed to encode alerts: %v\n", err)
+		return
+	}
+
+	for _, url := range n.cfg.URLs {
+		url := url
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			err := utils.RetryWithBackoff(ctx, func() error {
+				return n.post(ctx, url, b)
+			}, n.cfg.MaxAttempts, n.cfg.BaseDelay, n.cfg.MaxDelay)
+			if err != nil {
+				log.Printf("failed to deliver alerts to %s: %v\n", url, err)
+			}
+		}()
+	}
+}
+
+func (n *Notifier) post(ctx context.Context, url string, b []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Wait blocks until all in-flight deliveries are done.
+func (n *Notifier) Wait() {
+	n.wg.Wait()
+}
+
+func (n *Notifier) groupLabels(a Alert) map[string]string {
+	labels := map[string]string{}
+	for _, l := range n.cfg.GroupBy {
+		labels[l] = a.Labels[l]
+	}
+	return labels
+}
+
+func (n *Notifier) groupKey(a Alert) string {
+	labels := n.groupLabels(a)
+	keys := make([]string, 0, len(labels))
+	for k, v := range labels {
+		keys = append(keys, k+"="+v)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,136 @@
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNotifier_Flush(t *testing.T) {
+	var mux sync.Mutex
+	var received []Payload
+	attempts := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var p Payload
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&p)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received = append(received, p)
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+	n := NewNotifier(NotifierConfig{
+		URLs:           []string{ts.URL},
+		GroupBy:        []string{"severity"},
+		GroupWait:      30 * time.Second,
+		RepeatInterval: time.Hour,
+		MaxAttempts:    3,
+		BaseDelay:      time.Millisecond,
+		MaxDelay:       time.Millisecond,
+	})
+	n.now = func() time.Time { return now }
+
+	ctx := context.Background()
+	alerts := []Alert{
+		{Rule: "HighHeapUsage", State: StateFiring, Labels: map[string]string{"severity": "warning"}},
+		{Rule: "HighGC", State: StatePending, Labels: map[string]string{"severity": "warning"}},
+	}
+
+	n.Flush(ctx, alerts)
+	n.Wait()
+	assert.Empty(t, received, "group wait has not passed")
+
+	now = now.Add(30 * time.Second)
+	alerts = append(alerts, Alert{Rule: "LowDisk", State: StateFiring, Labels: map[string]string{"severity": "warning"}})
+	n.Flush(ctx, alerts)
+	n.Wait()
+	require.Len(t, received, 1)
+	assert.Equal(t, 2, attempts)
+	assert.Equal(t, "firing", received[0].Status)
+	assert.Equal(t, map[string]string{"severity": "warning"}, received[0].GroupLabels)
+	assert.Len(t, received[0].Alerts, 2)
+
+	now = now.Add(time.Minute)
+	n.Flush(ctx, alerts)
+	n.Wait()
+	assert.Len(t, received, 1, "nothing changed before repeat interval")
+
+	now = now.Add(time.Hour)
+	n.Flush(ctx, alerts)
+	n.Wait()
+	assert.Len(t, received, 2, "firing alerts are repeated")
+
+	alerts = []Alert{
+		{Rule: "HighHeapUsage", State: StateResolved, Labels: map[string]string{"severity": "warning"}},
+		{Rule: "LowDisk", State: StateResolved, Labels: map[string]string{"severity": "warning"}},
+	}
+	now = now.Add(time.Minute)
+	n.Flush(ctx, alerts)
+	now = now.Add(30 * time.Second)
+	n.Flush(ctx, alerts)
+	n.Wait()
+	require.Len(t, received, 3)
+	assert.Equal(t, "resolved", received[2].Status)
+
+	now = now.Add(time.Hour)
+	n.Flush(ctx, alerts)
+	n.Wait()
+	assert.Len(t, received, 3, "resolved alerts are sent once")
+}
+
+func TestNotifier_Silenced(t *testing.T) {
+	var mux sync.Mutex
+	var received []Payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var p Payload
+		if !assert.NoError(t, json.NewDecoder(r.Body).Decode(&p)) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mux.Lock()
+		defer mux.Unlock()
+		received = append(received, p)
+	}))
+	defer ts.Close()
+
+	now := time.Now()
+	n := NewNotifier(NotifierConfig{URLs: []string{ts.URL}, RepeatInterval: time.Hour})
+	n.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	n.Flush(ctx, []Alert{{Rule: "HighHeapUsage", State: StateFiring}})
+	n.Wait()
+	require.Len(t, received, 1)
+
+	silenced := []Alert{{Rule: "HighHeapUsage", State: StateFiring, SilencedBy: []string{"s1"}}}
+	now = now.Add(2 * time.Hour)
+	n.Flush(ctx, silenced)
+	n.Wait()
+	assert.Len(t, received, 1, "silenced alerts are not repeated")
+
+	now = now.Add(time.Minute)
+	n.Flush(ctx, []Alert{{Rule: "HighHeapUsage", State: StateResolved, SilencedBy: []string{"s1"}}})
+	n.Wait()
+	require.Len(t, received, 2)
+	assert.Equal(t, "resolved", received[1].Status)
+
+	n.Flush(ctx, []Alert{{Rule: "LowDisk", State: StateFiring, SilencedBy: []string{"s1"}}})
+	n.Flush(ctx, []Alert{{Rule: "LowDisk", State: StateResolved, SilencedBy: []string{"s1"}}})
+	n.Wait()
+	assert.Len(t, received, 2, "alerts silenced while firing are never sent")
+}
@@ -0,0 +1,116 @@
+package alerting
+
+import (
+	"errors"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"gopkg.in/yaml.v3"
+	"os"
+	"time"
+)
+
+// Rule fires when the value of a metric compares to Threshold using Op for at
+// least For. It is evaluated for every series of the metric whose labels
+// match Matchers, and each of them has its own alert.
+//
+//	rules:
+//	  - name: HighHeapUsage
+//	    metric: HeapAlloc
+//	    type: gauge
+//	    matchers:
+//	      env: prod
+//	    op: ">"
+//	    threshold: 1e9
+//	    for: 1m
+//	    labels:
+//	      severity: warning
+//	    annotations:
+//	      summary: heap usage is above 1GB
+type Rule struct {
+	Name        string            `yaml:"name" json:"name"`
+	Metric      string            `yaml:"metric" json:"metric"`
+	MType       string            `yaml:"type" json:"type"`
+	Matchers    metrics.Labels    `yaml:"matchers" json:"matchers,omitempty"`
+	Op          string            `yaml:"op" json:"op"`
+	Threshold   float64           `yaml:"threshold" json:"threshold"`
+	For         time.Duration     `yaml:"for" json:"for"`
+	Labels      map[string]string `yaml:"labels" json:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations" json:"annotations,omitempty"`
+}
+
+type rulesFile struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// LoadRules reads and validates the rules from a YAML file.
+func LoadRules(fileName string) ([]Rule, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var f rulesFile
+	if err := yaml.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse rules %s: %w", fileName, err)
+	}
+
+	names := map[string]bool{}
+	for _, r := range f.Rules {
+		if err := r.Validate(); err != nil {
+			return nil, err
+		}
+		if names[r.Name] {
+			return nil, fmt.Errorf("duplicate rule %q", r.Name)
+		}
+		names[r.Name] = true
+	}
+	return f.Rules, nil
+}
+
+func (r Rule) Validate() error {
+	if r.Name == "" {
+		return errors.New("rule name is empty")
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("rule %q: metric is empty", r.Name)
+	}
+	if r.MType != storage.Gauge && r.MType != storage.Counter {
+		return fmt.Errorf("rule %q: %w %q", r.Name, storage.ErrInvalidType, r.MType)
+	}
+	if err := r.Matchers.Validate(); err != nil {
+		return fmt.Errorf("rule %q: %w", r.Name, err)
+	}
+	if _, err := compare(r.Op, 0, 0); err != nil {
+		return fmt.Errorf("rule %q: %w", r.Name, err)
+	}
+	if r.For < 0 {
+		return fmt.Errorf("rule %q: negative for duration", r.Name)
+	}
+	return nil
+}
+
+// Matches reports whether value satisfies the rule condition.
+func (r Rule) Matches(value float64) bool {
+	ok, _ := compare(r.Op, value, r.Threshold)
+	return ok
+}
+
+func compare(op string, value, threshold float64) (bool, error) {
+	switch op {
+	case ">":
+		return value > threshold, nil
+	case ">=":
+		return value >= threshold, nil
+	case "<":
+		return value < threshold, nil
+	case "<=":
+		return value <= threshold, nil
+	case "==":
+		return value == threshold, nil
+	case "!=":
+		return value != threshold, nil
+	default:
+		return false, fmt.Errorf("unknown operator %q", op)
+	}
+}
@@ -0,0 +1,58 @@
+package alerting
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"log"
+	"time"
+)
+
+// Silencer marks alerts matched by active silences.
+type Silencer struct {
+	repo storage.SilenceRepository
+	now  func() time.Time
+}
+
+func NewSilencer(repo storage.SilenceRepository) *Silencer {
+	return &Silencer{
+		repo: repo,
+		now:  time.Now,
+	}
+}
+
+// Apply fills in SilencedBy of every alert. Alerts are returned unchanged
+// when the silences cannot be loaded.
+func (s *Silencer) Apply(ctx context.Context, alerts []Alert) []Alert {
+	silences, err := s.repo.ListSilences(ctx)
+	if err != nil {
+		log.Printf("failed to load silences: %v\n", err)
+		return alerts
+	}
+
+	now := s.now()
+	for i := range alerts {
+		alerts[i].SilencedBy = nil
+		for _, v := range silences {
+			if v.Active(now) && Matches(v.Matchers, alerts[i]) {
+				alerts[i].SilencedBy = append(alerts[i].SilencedBy, v.ID)
+			}
+		}
+	}
+	return alerts
+}
+
+// Matches reports whether the alert is selected by m.
+func Matches(m storage.Matchers, a Alert) bool {
+	if m.Metric != "" && m.Metric != a.Metric {
+		return false
+	}
+	if m.MType != "" && m.MType != a.MType {
+		return false
+	}
+	for k, v := range m.Labels {
+		if a.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
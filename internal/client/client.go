@@ -2,40 +2,128 @@ package client
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
+	"compress/gzip"
+	"context"
+	"crypto/rsa"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/caarlos0/env/v7"
+	"github.com/eugeniylennik/alertics/internal/encryption"
 	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/rpc"
 	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/eugeniylennik/alertics/internal/tlsconfig"
+	"google.golang.org/grpc"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/cookiejar"
 	"net/url"
 	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ErrResponseSignature is returned when the signature of a response does not
+// match its body.
+var ErrResponseSignature = errors.New("response signature mismatch")
+
 type Client struct {
 	Config *Agent
 	*http.Client
+	Retry RetryPolicy
+	// slots bounds the number of requests in flight.
+	slots   chan struct{}
+	limiter *TokenBucket
+	// publicKey encrypts request bodies when set.
+	publicKey *rsa.PublicKey
+	scheme    string
+	// rpc sends the metrics when the gRPC transport is selected.
+	rpc  *rpc.MetricsClient
+	conn *grpc.ClientConn
+	// labels are attached to every metric sent.
+	labels metrics.Labels
+	// localIP caches the address of the interface used to reach the server.
+	localIP atomic.Value
+	stats   struct {
+		requests, attempts, retries, failures int64
+	}
+	// latency holds the durations of the request attempts since the last
+	// collection.
+	latencyMux sync.Mutex
+	latency    *metrics.Histogram
 }
 
 type Agent struct {
-	Address        string        `env:"ADDRESS" envDefault:"localhost:8080"`
-	ReportInterval time.Duration `env:"REPORT_INTERVAL" envDefault:"10s"`
-	PoolInterval   time.Duration `env:"POLL_INTERVAL" envDefault:"2s"`
-	Key            string        `env:"KEY" envDefault:"key"`
+	Address           string        `env:"ADDRESS" envDefault:"localhost:8080"`
+	ReportInterval    time.Duration `env:"REPORT_INTERVAL" envDefault:"10s"`
+	PoolInterval      time.Duration `env:"POLL_INTERVAL" envDefault:"2s"`
+	Key               string        `env:"KEY"`
+	Collectors        string        `env:"COLLECTORS"`
+	CollectTimeout    time.Duration `env:"COLLECT_TIMEOUT" envDefault:"5s"`
+	SpoolDir          string        `env:"SPOOL_DIR" envDefault:"/tmp/alertics-agent-spool"`
+	SpoolMaxSize      int64         `env:"SPOOL_MAX_SIZE" envDefault:"67108864"`
+	RetryMaxAttempts  int           `env:"RETRY_MAX_ATTEMPTS" envDefault:"3"`
+	RetryBaseDelay    time.Duration `env:"RETRY_BASE_DELAY" envDefault:"1s"`
+	RetryMaxDelay     time.Duration `env:"RETRY_MAX_DELAY" envDefault:"5s"`
+	RetryJitter       float64       `env:"RETRY_JITTER" envDefault:"0.2"`
+	RateLimit         int           `env:"RATE_LIMIT" envDefault:"4"`
+	BatchSize         int           `env:"BATCH_SIZE" envDefault:"500"`
+	RequestsPerSecond float64       `env:"REQUESTS_PER_SECOND" envDefault:"10"`
+	RequestsBurst     int           `env:"REQUESTS_BURST" envDefault:"20"`
+	GzipThreshold     int           `env:"GZIP_THRESHOLD" envDefault:"1024"`
+	GzipLevel         int           `env:"GZIP_LEVEL" envDefault:"-1"`
+	SignatureVersion  int           `env:"SIGNATURE_VERSION" envDefault:"2"`
+	CryptoKey         string        `env:"CRYPTO_KEY"`
+	TLS               bool          `env:"TLS"`
+	TLSCA             string        `env:"TLS_CA"`
+	TLSCert           string        `env:"TLS_CERT"`
+	TLSKey            string        `env:"TLS_KEY"`
+	TLSServerName     string        `env:"TLS_SERVER_NAME"`
+	Transport         string        `env:"TRANSPORT" envDefault:"http"`
+	GRPCAddress       string        `env:"GRPC_ADDRESS" envDefault:"localhost:3200"`
+	Labels            string        `env:"LABELS"`
+	LabelHostname     bool          `env:"LABEL_HOSTNAME"`
+	HistogramBuckets  string        `env:"HISTOGRAM_BUCKETS"`
 }
 
 var (
 	address        = flag.String("a", "localhost:8080", "server address")
 	reportInterval = flag.Duration("r", 10*time.Second, "report interval")
 	poolInterval   = flag.Duration("p", 2*time.Second, "pool interval")
-	key            = flag.String("k", "key", "key secret")
+	key            = flag.String("k", "", "key to sign metrics with, empty disables signing")
+	collectors     = flag.String("collectors", "", "collectors to run, e.g. runtime,cpu:10s,-network")
+	collectTimeout = flag.Duration("collect-timeout", 5*time.Second, "timeout of a single collection")
+	spoolDir       = flag.String("spool-dir", "/tmp/alertics-agent-spool", "directory of batches waiting to be sent")
+	spoolMaxSize   = flag.Int64("spool-max-size", 64<<20, "max size of spooled batches in bytes")
+	retryAttempts  = flag.Int("retry-max-attempts", 3, "max attempts of a request")
+	retryBaseDelay = flag.Duration("retry-base-delay", time.Second, "delay before the first retry")
+	retryMaxDelay  = flag.Duration("retry-max-delay", 5*time.Second, "max delay between retries")
+	retryJitter    = flag.Float64("retry-jitter", 0.2, "randomized fraction of the retry delay")
+	rateLimit      = flag.Int("l", 4, "max concurrent outbound requests")
+	batchSize      = flag.Int("batch-size", 500, "max metrics per batch request")
+	rps            = flag.Float64("rps", 10, "max outbound requests per second, 0 disables the limit")
+	rpsBurst       = flag.Int("rps-burst", 20, "max burst of outbound requests")
+	gzipThreshold  = flag.Int("gzip-threshold", 1024, "min body size in bytes to compress, negative disables compression")
+	gzipLevel      = flag.Int("gzip-level", gzip.DefaultCompression, "gzip compression level")
+	signatureVer   = flag.Int("signature-version", metrics.SignatureCanonical, "signature version, 1 for servers without canonical signatures")
+	cryptoKey      = flag.String("crypto-key", "", "PEM file with the server public key to encrypt request bodies with")
+	useTLS         = flag.Bool("tls", false, "send metrics over HTTPS, implied by the other TLS options")
+	tlsCA          = flag.String("tls-ca", "", "PEM file with the CAs to verify the server with instead of the system ones")
+	tlsCert        = flag.String("tls-cert", "", "PEM client certificate file for mutual TLS")
+	tlsKey         = flag.String("tls-key", "", "PEM private key file of the client certificate")
+	tlsServerName  = flag.String("tls-server-name", "", "name to verify the server certificate against instead of the address host")
+	transport      = flag.String("transport", "http", "transport to send metrics with, http or grpc")
+	grpcAddress    = flag.String("grpc-address", "localhost:3200", "gRPC server address")
+	labels         = flag.String("labels", "", "labels to attach to every metric, e.g. env=prod,region=eu")
+	labelHostname  = flag.Bool("label-hostname", false, "attach the host label with the hostname to every metric")
+	histBuckets    = flag.String("histogram-buckets", "", "bucket bounds in seconds of the request latency histogram, e.g. 0.01,0.1,1")
 )
 
 func InitConfigAgent() *Agent {
@@ -67,6 +155,110 @@ func InitConfigAgent() *Agent {
 		cfg.Key = *key
 	}
 
+	if envCollectors := os.Getenv("COLLECTORS"); envCollectors == "" {
+		cfg.Collectors = *collectors
+	}
+
+	if envCollectTimeout := os.Getenv("COLLECT_TIMEOUT"); envCollectTimeout == "" {
+		cfg.CollectTimeout = *collectTimeout
+	}
+
+	if envSpoolDir := os.Getenv("SPOOL_DIR"); envSpoolDir == "" {
+		cfg.SpoolDir = *spoolDir
+	}
+
+	if envSpoolMaxSize := os.Getenv("SPOOL_MAX_SIZE"); envSpoolMaxSize == "" {
+		cfg.SpoolMaxSize = *spoolMaxSize
+	}
+
+	if envRetryAttempts := os.Getenv("RETRY_MAX_ATTEMPTS"); envRetryAttempts == "" {
+		cfg.RetryMaxAttempts = *retryAttempts
+	}
+
+	if envRetryBaseDelay := os.Getenv("RETRY_BASE_DELAY"); envRetryBaseDelay == "" {
+		cfg.RetryBaseDelay = *retryBaseDelay
+	}
+
+	if envRetryMaxDelay := os.Getenv("RETRY_MAX_DELAY"); envRetryMaxDelay == "" {
+		cfg.RetryMaxDelay = *retryMaxDelay
+	}
+
+	if envRetryJitter := os.Getenv("RETRY_JITTER"); envRetryJitter == "" {
+		cfg.RetryJitter = *retryJitter
+	}
+
+	if envRateLimit := os.Getenv("RATE_LIMIT"); envRateLimit == "" {
+		cfg.RateLimit = *rateLimit
+	}
+
+	if envBatchSize := os.Getenv("BATCH_SIZE"); envBatchSize == "" {
+		cfg.BatchSize = *batchSize
+	}
+
+	if envRPS := os.Getenv("REQUESTS_PER_SECOND"); envRPS == "" {
+		cfg.RequestsPerSecond = *rps
+	}
+
+	if envRPSBurst := os.Getenv("REQUESTS_BURST"); envRPSBurst == "" {
+		cfg.RequestsBurst = *rpsBurst
+	}
+
+	if envGzipThreshold := os.Getenv("GZIP_THRESHOLD"); envGzipThreshold == "" {
+		cfg.GzipThreshold = *gzipThreshold
+	}
+
+	if envGzipLevel := os.Getenv("GZIP_LEVEL"); envGzipLevel == "" {
+		cfg.GzipLevel = *gzipLevel
+	}
+
+	if envSignatureVer := os.Getenv("SIGNATURE_VERSION"); envSignatureVer == "" {
+		cfg.SignatureVersion = *signatureVer
+	}
+
+	if envCryptoKey := os.Getenv("CRYPTO_KEY"); envCryptoKey == "" {
+		cfg.CryptoKey = *cryptoKey
+	}
+
+	if envTLS := os.Getenv("TLS"); envTLS == "" {
+		cfg.TLS = *useTLS
+	}
+
+	if envTLSCA := os.Getenv("TLS_CA"); envTLSCA == "" {
+		cfg.TLSCA = *tlsCA
+	}
+
+	if envTLSCert := os.Getenv("TLS_CERT"); envTLSCert == "" {
+		cfg.TLSCert = *tlsCert
+	}
+
+	if envTLSKey := os.Getenv("TLS_KEY"); envTLSKey == "" {
+		cfg.TLSKey = *tlsKey
+	}
+
+	if envTLSServerName := os.Getenv("TLS_SERVER_NAME"); envTLSServerName == "" {
+		cfg.TLSServerName = *tlsServerName
+	}
+
+	if envTransport := os.Getenv("TRANSPORT"); envTransport == "" {
+		cfg.Transport = *transport
+	}
+
+	if envGRPCAddress := os.Getenv("GRPC_ADDRESS"); envGRPCAddress == "" {
+		cfg.GRPCAddress = *grpcAddress
+	}
+
+	if envLabels := os.Getenv("LABELS"); envLabels == "" {
+		cfg.Labels = *labels
+	}
+
+	if envLabelHostname := os.Getenv("LABEL_HOSTNAME"); envLabelHostname == "" {
+		cfg.LabelHostname = *labelHostname
+	}
+
+	if envHistogramBuckets := os.Getenv("HISTOGRAM_BUCKETS"); envHistogramBuckets == "" {
+		cfg.HistogramBuckets = *histBuckets
+	}
+
 	return cfg
 }
 
@@ -75,119 +267,300 @@ func NewHTTPClient(cfg *Agent) (*Client, error) {
 	if err != nil {
 		return &Client{}, err
 	}
-	return &Client{
+	if _, err := gzip.NewWriterLevel(io.Discard, cfg.GzipLevel); err != nil {
+		return &Client{}, err
+	}
+	if cfg.Key != "" && cfg.SignatureVersion != metrics.SignatureLegacy && cfg.SignatureVersion != metrics.SignatureCanonical {
+		return &Client{}, fmt.Errorf("unknown signature version %d", cfg.SignatureVersion)
+	}
+	labels, err := staticLabels(cfg)
+	if err != nil {
+		return &Client{}, err
+	}
+	buckets := metrics.DefaultBuckets
+	if cfg.HistogramBuckets != "" {
+		if buckets, err = metrics.ParseBuckets(cfg.HistogramBuckets); err != nil {
+			return &Client{}, err
+		}
+	}
+	var publicKey *rsa.PublicKey
+	if cfg.CryptoKey != "" {
+		if publicKey, err = encryption.LoadPublicKey(cfg.CryptoKey); err != nil {
+			return &Client{}, err
+		}
+	}
+	transport := &http.Transport{
+		MaxIdleConns: 20,
+	}
+	scheme := "http"
+	var tlsConfig *tls.Config
+	if cfg.TLS || cfg.TLSCA != "" || cfg.TLSCert != "" || cfg.TLSKey != "" || cfg.TLSServerName != "" {
+		if tlsConfig, err = tlsconfig.Client(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey, cfg.TLSServerName); err != nil {
+			return &Client{}, err
+		}
+		transport.TLSClientConfig = tlsConfig
+		scheme = "https"
+	}
+	var conn *grpc.ClientConn
+	switch cfg.Transport {
+	case "", "http":
+	case "grpc":
+		if conn, err = dialGRPC(cfg.GRPCAddress, tlsConfig); err != nil {
+			return &Client{}, err
+		}
+	default:
+		return &Client{}, fmt.Errorf("unknown transport %q", cfg.Transport)
+	}
+	rateLimit := cfg.RateLimit
+	if rateLimit < 1 {
+		rateLimit = 1
+	}
+	c := &Client{
 		Config: cfg,
 		Client: &http.Client{
-			Timeout: time.Second * 5,
-			Transport: &http.Transport{
-				MaxIdleConns: 20,
-			},
-			Jar: jar,
+			Timeout:   time.Second * 5,
+			Transport: transport,
+			Jar:       jar,
 		},
-	}, nil
-}
-
-func (c *Client) SendMetrics(d []metrics.Data) error {
-	if len(d) == 0 {
-		return nil
+		Retry: RetryPolicy{
+			MaxAttempts:       cfg.RetryMaxAttempts,
+			BaseDelay:         cfg.RetryBaseDelay,
+			MaxDelay:          cfg.RetryMaxDelay,
+			Jitter:            cfg.RetryJitter,
+			RetryableStatuses: DefaultRetryableStatuses,
+			RetryableCodes:    DefaultRetryableCodes,
+		},
+		slots:     make(chan struct{}, rateLimit),
+		limiter:   NewTokenBucket(cfg.RequestsPerSecond, cfg.RequestsBurst),
+		publicKey: publicKey,
+		scheme:    scheme,
+		conn:      conn,
+		labels:    labels,
+		latency:   metrics.NewHistogram(buckets),
 	}
-	addr := url.URL{
-		Scheme: "http",
-		Host:   c.Config.Address,
-		Path:   "/update",
+	if conn != nil {
+		c.rpc = rpc.NewMetricsClient(conn)
 	}
+	return c, nil
+}
 
-	for _, v := range d {
-		m := metrics.Metrics{
-			ID:    v.Name,
-			MType: v.Type,
+// staticLabels returns the labels configured for every metric. The host label
+// defaults to the hostname when LabelHostname is set.
+func staticLabels(cfg *Agent) (metrics.Labels, error) {
+	labels, err := metrics.ParseLabelList(cfg.Labels)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LabelHostname {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
 		}
+		labels = labels.Merge(metrics.Labels{"host": host})
+	}
+	return labels, nil
+}
 
-		if v.Type == storage.Gauge {
-			m.Value = &v.Value
-		} else {
-			i := int64(v.Value)
-			m.Delta = &i
-		}
+// Close releases the gRPC connection.
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
 
-		if c.Config.Key != "" {
-			m.Hash = generateHash(m, c.Config.Key)
+// SendMetrics sends every metric in its own request.
+func (c *Client) SendMetrics(ctx context.Context, d []metrics.Data) error {
+	return c.dispatch(ctx, split(d, 1), func(ctx context.Context, d []metrics.Data) error {
+		if c.rpc != nil {
+			return c.updateMetricRPC(ctx, d[0])
 		}
-
-		b, err := json.Marshal(m)
+		b, err := json.Marshal(c.toMetrics(d[0]))
 		if err != nil {
 			return err
 		}
+		return c.post(ctx, "/update", b)
+	})
+}
 
-		req, err := http.NewRequest(
-			http.MethodPost,
-			addr.String(),
-			bytes.NewBuffer(b),
-		)
-		if err != nil {
-			return err
+// SendMetricsBatch sends d in chunks of up to BatchSize metrics.
+func (c *Client) SendMetricsBatch(ctx context.Context, d []metrics.Data) error {
+	return c.dispatch(ctx, split(d, c.Config.BatchSize), func(ctx context.Context, d []metrics.Data) error {
+		if c.rpc != nil {
+			return c.updateMetricsBatchRPC(ctx, d)
 		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("Accept-Encoding", "gzip")
-		resp, err := c.Do(req)
+		result := make([]metrics.Metrics, len(d))
+		for i, v := range d {
+			result[i] = c.toMetrics(v)
+		}
+
+		b, err := json.Marshal(result)
 		if err != nil {
 			return err
 		}
-		defer func() {
-			if err := resp.Body.Close(); err != nil {
-				log.Printf("error closing response body: %v", err)
-			}
-		}()
+		return c.post(ctx, "/updates", b)
+	})
+}
+
+// signatureReuse is how long retries reuse the canonical signature of a
+// metric. The server remembers nonces while their timestamp is valid, 5
+// minutes by default, so a retry of a metric it already stored is rejected as
+// a replay instead of being counted twice. Older metrics are signed again so
+// their timestamp is still accepted.
+const signatureReuse = 4 * time.Minute
+
+// Stamp returns d with a canonical signature timestamp and nonce set on the
+// metrics that do not have one yet, so that retries of d, including replays
+// of the spool, are recognized by the server.
+func (c *Client) Stamp(d []metrics.Data) []metrics.Data {
+	if c.Config.Key == "" || c.Config.SignatureVersion != metrics.SignatureCanonical {
+		return d
 	}
-	return nil
+	result := make([]metrics.Data, len(d))
+	now := time.Now().Unix()
+	for i, v := range d {
+		if v.Nonce == "" {
+			v.Timestamp, v.Nonce = now, metrics.NewNonce()
+		}
+		result[i] = v
+	}
+	return result
 }
 
-func (c *Client) SendMetricsBatch(d []metrics.Data) error {
-	if len(d) == 0 {
-		return nil
+func (c *Client) toMetrics(v metrics.Data) metrics.Metrics {
+	m := metrics.Metrics{
+		ID:     v.Name,
+		MType:  v.Type,
+		Labels: c.labels,
+	}
+
+	switch v.Type {
+	case storage.Gauge:
+		value := v.Value
+		m.Value = &value
+	case storage.Histogram:
+		m.Histogram = v.Histogram
+	default:
+		i := int64(v.Value)
+		m.Delta = &i
+	}
+
+	if c.Config.Key != "" {
+		if c.Config.SignatureVersion == metrics.SignatureCanonical {
+			m.Timestamp, m.Nonce = v.Timestamp, v.Nonce
+			if m.Nonce == "" || time.Since(time.Unix(m.Timestamp, 0)) >= signatureReuse {
+				m.Timestamp = time.Now().Unix()
+				m.Nonce = metrics.NewNonce()
+			}
+		}
+		m.Hash = m.ComputeHash(c.Config.Key, c.Config.SignatureVersion)
 	}
+	return m
+}
+
+// post sends b to path and retries failed attempts according to the retry
+// policy. The body is compressed, then encrypted, and the signature covers
+// it as sent.
+func (c *Client) post(ctx context.Context, path string, b []byte) error {
 	addr := url.URL{
-		Scheme: "http",
+		Scheme: c.scheme,
 		Host:   c.Config.Address,
-		Path:   "/updates",
+		Path:   path,
 	}
 
-	result := make([]metrics.Metrics, len(d))
-
-	for i, v := range d {
-		m := metrics.Metrics{
-			ID:    v.Name,
-			MType: v.Type,
+	encoding := ""
+	if c.Config.GzipThreshold >= 0 && len(b) >= c.Config.GzipThreshold {
+		var err error
+		if b, err = compress(b, c.Config.GzipLevel); err != nil {
+			return err
 		}
-
-		if v.Type == storage.Gauge {
-			m.Value = &v.Value
-		} else {
-			i := int64(v.Value)
-			m.Delta = &i
+		encoding = "gzip"
+	}
+	encrypted := c.publicKey != nil
+	if encrypted {
+		var err error
+		if b, err = encryption.Encrypt(c.publicKey, b); err != nil {
+			return err
 		}
+	}
+
+	return c.withRetry(ctx, func(ctx context.Context) error {
+		return c.postOnce(ctx, addr.String(), b, encoding, encrypted)
+	})
+}
 
-		if c.Config.Key != "" {
-			m.Hash = generateHash(m, c.Config.Key)
+// withRetry makes a request with attempt, retrying failed attempts according
+// to the retry policy. Every attempt waits for the rate limiter and a free
+// slot.
+func (c *Client) withRetry(ctx context.Context, attempt func(ctx context.Context) error) error {
+	atomic.AddInt64(&c.stats.requests, 1)
+	for n := 1; ; n++ {
+		atomic.AddInt64(&c.stats.attempts, 1)
+		err := c.limit(ctx, attempt)
+		if err == nil {
+			return nil
+		}
+		if n >= c.Retry.MaxAttempts || !c.Retry.retryable(err) {
+			atomic.AddInt64(&c.stats.failures, 1)
+			return err
 		}
 
-		result[i] = m
+		atomic.AddInt64(&c.stats.retries, 1)
+		t := time.NewTimer(c.Retry.delay(n, err))
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			atomic.AddInt64(&c.stats.failures, 1)
+			return err
+		}
 	}
+}
 
-	b, err := json.Marshal(result)
-	if err != nil {
+func (c *Client) limit(ctx context.Context, attempt func(ctx context.Context) error) error {
+	if err := c.limiter.Wait(ctx); err != nil {
 		return err
 	}
-	req, err := http.NewRequest(
-		http.MethodPost,
-		addr.String(),
-		bytes.NewBuffer(b),
-	)
+	select {
+	case c.slots <- struct{}{}:
+		defer func() { <-c.slots }()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	start := time.Now()
+	err := attempt(ctx)
+	c.observeLatency(time.Since(start))
+	return err
+}
+
+func (c *Client) observeLatency(d time.Duration) {
+	c.latencyMux.Lock()
+	defer c.latencyMux.Unlock()
+	if c.latency != nil {
+		c.latency.Observe(d.Seconds())
+	}
+}
+
+func (c *Client) postOnce(ctx context.Context, addr string, b []byte, encoding string, encrypted bool) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, addr, bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Accept-Encoding", "gzip")
+	if encoding != "" {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+	if encrypted {
+		req.Header.Set(encryption.Header, encryption.Scheme)
+	}
+	if ip := c.realIP(); ip != "" {
+		req.Header.Set("X-Real-IP", ip)
+	}
+	if c.Config.Key != "" {
+		req.Header.Set(metrics.SignatureVersionHeader, strconv.Itoa(c.Config.SignatureVersion))
+		req.Header.Set(metrics.BodyHashHeader, metrics.BodyHash(c.Config.Key, b))
+	}
 	resp, err := c.Do(req)
 	if err != nil {
 		return err
@@ -197,20 +570,93 @@ func (c *Client) SendMetricsBatch(d []metrics.Data) error {
 			log.Printf("error closing response body: %v", err)
 		}
 	}()
-	return nil
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{
+			StatusCode: resp.StatusCode,
+			Status:     resp.Status,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return c.verifyResponse(resp)
+}
+
+// realIP returns the address of the interface the agent reaches the server
+// through, so the server can check it against its trusted subnet. Dialing UDP
+// sends no packets; it only picks the route. Failures are retried on the next
+// request.
+func (c *Client) realIP() string {
+	if ip, ok := c.localIP.Load().(string); ok {
+		return ip
+	}
+	addr := c.Config.Address
+	if c.rpc != nil {
+		addr = c.Config.GRPCAddress
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Printf("failed to find the outbound address: %v\n", err)
+		return ""
+	}
+	defer conn.Close()
+
+	ip := conn.LocalAddr().(*net.UDPAddr).IP.String()
+	c.localIP.Store(ip)
+	return ip
 }
 
-func generateHash(m metrics.Metrics, k string) string {
-	h := hmac.New(sha256.New, []byte(k))
+// verifyResponse checks the signature of a response. Servers without body
+// signing do not send one, so only a mismatching signature is an error.
+func (c *Client) verifyResponse(resp *http.Response) error {
+	hash := resp.Header.Get(metrics.BodyHashHeader)
+	if c.Config.Key == "" || hash == "" {
+		return nil
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if hash != metrics.BodyHash(c.Config.Key, body) {
+		return ErrResponseSignature
+	}
+	return nil
+}
 
-	var msg string
-	if m.MType == storage.Counter {
-		msg = fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta)
-	} else {
-		msg = fmt.Sprintf("%s:gauge:%.f", m.ID, *m.Value)
+func compress(b []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := gz.Write(b); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
 	}
+	return buf.Bytes(), nil
+}
 
-	h.Write([]byte(msg))
+// Name and Collect make the client a collector of its own request
+// statistics, reported as counters since the previous collection.
+func (c *Client) Name() string {
+	return "agent"
+}
 
-	return hex.EncodeToString(h.Sum(nil))
+// Collect reports the request statistics and the histogram of the durations
+// of request attempts in seconds since the last collection.
+func (c *Client) Collect(_ context.Context) ([]metrics.Data, error) {
+	d := []metrics.Data{
+		{Name: "AgentRequests", Type: storage.Counter, Value: float64(atomic.SwapInt64(&c.stats.requests, 0))},
+		{Name: "AgentRequestAttempts", Type: storage.Counter, Value: float64(atomic.SwapInt64(&c.stats.attempts, 0))},
+		{Name: "AgentRequestRetries", Type: storage.Counter, Value: float64(atomic.SwapInt64(&c.stats.retries, 0))},
+		{Name: "AgentRequestFailures", Type: storage.Counter, Value: float64(atomic.SwapInt64(&c.stats.failures, 0))},
+	}
+
+	c.latencyMux.Lock()
+	defer c.latencyMux.Unlock()
+	if c.latency != nil {
+		d = append(d, metrics.Data{Name: "AgentRequestDuration", Type: storage.Histogram, Histogram: c.latency})
+		c.latency = metrics.NewHistogram(c.latency.Buckets)
+	}
+	return d, nil
 }
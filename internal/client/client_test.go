@@ -0,0 +1,400 @@
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/router"
+	"github.com/eugeniylennik/alertics/internal/rpc"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, h http.HandlerFunc) *Client {
+	ts := httptest.NewServer(h)
+	t.Cleanup(ts.Close)
+
+	c, err := NewHTTPClient(&Agent{
+		Address:          strings.TrimPrefix(ts.URL, "http://"),
+		RetryMaxAttempts: 3,
+		RetryBaseDelay:   time.Millisecond,
+		RetryMaxDelay:    10 * time.Millisecond,
+		RetryJitter:      0.5,
+		RateLimit:        2,
+	})
+	require.NoError(t, err)
+	return c
+}
+
+func decodeBatch(t *testing.T, r *http.Request) []metrics.Metrics {
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		body = gz
+	}
+	var batch []metrics.Metrics
+	require.NoError(t, json.NewDecoder(body).Decode(&batch))
+	return batch
+}
+
+func TestClient_SendMetricsBatchRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantErr      bool
+		wantAttempts int64
+	}{
+		{name: "success", statuses: []int{200}, wantAttempts: 1},
+		{name: "retryable", statuses: []int{503, 429, 200}, wantAttempts: 3},
+		{name: "exhausted", statuses: []int{502, 504, 503}, wantErr: true, wantAttempts: 3},
+		{name: "not retryable", statuses: []int{400}, wantErr: true, wantAttempts: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int64
+			c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt64(&calls, 1)
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(tt.statuses[n-1])
+			})
+
+			err := c.SendMetricsBatch(context.Background(), []metrics.Data{{Name: "Alloc", Type: "gauge", Value: 1}})
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tt.wantAttempts, calls)
+
+			d, err := c.Collect(context.Background())
+			require.NoError(t, err)
+			stats := map[string]float64{}
+			for _, v := range d {
+				stats[v.Name] = v.Value
+			}
+			assert.Equal(t, float64(tt.wantAttempts), stats["AgentRequestAttempts"])
+			assert.Equal(t, float64(tt.wantAttempts-1), stats["AgentRequestRetries"])
+		})
+	}
+}
+
+func TestRetryPolicy_Delay(t *testing.T) {
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	assert.Equal(t, time.Second, p.delay(1, nil))
+	assert.Equal(t, 4*time.Second, p.delay(3, nil))
+	assert.Equal(t, 5*time.Second, p.delay(10, nil))
+	assert.Equal(t, 2*time.Second, p.delay(1, &StatusError{StatusCode: 429, RetryAfter: 2 * time.Second}))
+	assert.Equal(t, 5*time.Second, p.delay(1, &StatusError{StatusCode: 429, RetryAfter: time.Minute}))
+
+	assert.Equal(t, 3*time.Second, parseRetryAfter("3", time.Now()))
+	now := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 10*time.Second, parseRetryAfter(now.Add(10*time.Second).Format(http.TimeFormat), now))
+}
+
+func TestClient_SendMetricsBatchChunks(t *testing.T) {
+	var inFlight, maxInFlight int64
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt64(&inFlight, 1)
+		defer atomic.AddInt64(&inFlight, -1)
+		for {
+			m := atomic.LoadInt64(&maxInFlight)
+			if n <= m || atomic.CompareAndSwapInt64(&maxInFlight, m, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		batch := decodeBatch(t, r)
+		if batch[0].ID == "Bad" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+	c.Config.BatchSize = 2
+
+	d := []metrics.Data{
+		{Name: "A", Type: "gauge", Value: 1},
+		{Name: "B", Type: "gauge", Value: 1},
+		{Name: "Bad", Type: "gauge", Value: 1},
+		{Name: "C", Type: "gauge", Value: 1},
+		{Name: "D", Type: "counter", Value: 1},
+		{Name: "E", Type: "counter", Value: 1},
+	}
+	err := c.SendMetricsBatch(context.Background(), d)
+	assert.Error(t, err)
+	assert.Empty(t, Unsent(err, d))
+	assert.Equal(t, d[2:4], Rejected(err, d))
+	assert.Equal(t, int64(2), maxInFlight)
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(10, 2)
+	now := b.last
+	assert.Zero(t, b.reserve(now))
+	assert.Zero(t, b.reserve(now))
+	assert.Equal(t, 100*time.Millisecond, b.reserve(now))
+	assert.Zero(t, b.reserve(now.Add(100*time.Millisecond)))
+}
+
+func TestClient_SendMetricsBatchCompresses(t *testing.T) {
+	var encodings []string
+	c := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		encodings = append(encodings, r.Header.Get("Content-Encoding"))
+		decodeBatch(t, r)
+	})
+	c.Config.GzipThreshold = 200
+	c.Config.GzipLevel = gzip.BestCompression
+
+	small := []metrics.Data{{Name: "Alloc", Type: "gauge", Value: 1}}
+	require.NoError(t, c.SendMetricsBatch(context.Background(), small))
+
+	var large []metrics.Data
+	for i := 0; i < 10; i++ {
+		large = append(large, metrics.Data{Name: fmt.Sprintf("Metric%d", i), Type: "gauge", Value: 1})
+	}
+	require.NoError(t, c.SendMetricsBatch(context.Background(), large))
+	assert.Equal(t, []string{"", "gzip"}, encodings)
+}
+
+func TestClient_SignedRequests(t *testing.T) {
+	const key = "secret"
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	ts := httptest.NewServer(router.NewRouter(repo, router.WithKey(key)))
+	t.Cleanup(ts.Close)
+
+	c, err := NewHTTPClient(&Agent{
+		Address:          strings.TrimPrefix(ts.URL, "http://"),
+		Key:              key,
+		SignatureVersion: metrics.SignatureCanonical,
+		RetryMaxAttempts: 1,
+		GzipThreshold:    1,
+		GzipLevel:        gzip.DefaultCompression,
+	})
+	require.NoError(t, err)
+
+	d := []metrics.Data{{Name: "PollCount", Type: "counter", Value: 2}, {Name: "Alloc", Type: "gauge", Value: 0.5}}
+	require.NoError(t, c.SendMetricsBatch(context.Background(), d))
+	require.NoError(t, c.SendMetrics(context.Background(), d))
+
+	m, err := repo.GetMetric(context.Background(), "counter", "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *m.Delta)
+
+	// A retry of a stamped batch the server already stored is a replay and
+	// does not count the counter twice.
+	stamped := c.Stamp(d)
+	require.NoError(t, c.SendMetricsBatch(context.Background(), stamped))
+	err = c.SendMetricsBatch(context.Background(), stamped)
+	assert.NotEmpty(t, Rejected(err, stamped))
+	m, err = repo.GetMetric(context.Background(), "counter", "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *m.Delta)
+
+	c.Config.Key = "other"
+	assert.Error(t, c.SendMetricsBatch(context.Background(), d))
+}
+
+func TestClient_Labels(t *testing.T) {
+	const key = "secret"
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	ts := httptest.NewServer(router.NewRouter(repo, router.WithKey(key)))
+	t.Cleanup(ts.Close)
+
+	c, err := NewHTTPClient(&Agent{
+		Address:          strings.TrimPrefix(ts.URL, "http://"),
+		Key:              key,
+		SignatureVersion: metrics.SignatureCanonical,
+		RetryMaxAttempts: 1,
+		GzipLevel:        gzip.DefaultCompression,
+		Labels:           "env=prod, region=eu",
+	})
+	require.NoError(t, err)
+
+	d := []metrics.Data{{Name: "PollCount", Type: "counter", Value: 2}}
+	require.NoError(t, c.SendMetricsBatch(context.Background(), d))
+
+	m, err := repo.GetMetric(context.Background(), "counter", "PollCount", metrics.Labels{"env": "prod", "region": "eu"})
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *m.Delta)
+
+	_, err = NewHTTPClient(&Agent{Labels: "env"})
+	assert.ErrorIs(t, err, metrics.ErrInvalidLabels)
+}
+
+func TestClient_RequestDuration(t *testing.T) {
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	ts := httptest.NewServer(router.NewRouter(repo))
+	t.Cleanup(ts.Close)
+
+	c, err := NewHTTPClient(&Agent{
+		Address:          strings.TrimPrefix(ts.URL, "http://"),
+		RetryMaxAttempts: 1,
+		GzipLevel:        gzip.DefaultCompression,
+		HistogramBuckets: "0.5,5",
+	})
+	require.NoError(t, err)
+
+	d := []metrics.Data{{Name: "PollCount", Type: "counter", Value: 1}}
+	require.NoError(t, c.SendMetrics(context.Background(), d))
+	require.NoError(t, c.SendMetrics(context.Background(), d))
+
+	stats, err := c.Collect(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, c.SendMetricsBatch(context.Background(), stats))
+
+	m, err := repo.GetMetric(context.Background(), storage.Histogram, "AgentRequestDuration", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 5}, m.Histogram.Buckets)
+	assert.Equal(t, uint64(2), m.Histogram.Count)
+
+	_, err = NewHTTPClient(&Agent{HistogramBuckets: "1,x"})
+	assert.ErrorIs(t, err, metrics.ErrInvalidHistogram)
+}
+
+func TestClient_EncryptedRequests(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "public.pem")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0644))
+
+	const key = "secret"
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	ts := httptest.NewServer(router.NewRouter(repo, router.WithKey(key), router.WithPrivateKey(priv)))
+	t.Cleanup(ts.Close)
+
+	c, err := NewHTTPClient(&Agent{
+		Address:          strings.TrimPrefix(ts.URL, "http://"),
+		Key:              key,
+		SignatureVersion: metrics.SignatureCanonical,
+		RetryMaxAttempts: 1,
+		GzipThreshold:    1,
+		GzipLevel:        gzip.DefaultCompression,
+		CryptoKey:        keyFile,
+	})
+	require.NoError(t, err)
+
+	d := []metrics.Data{{Name: "PollCount", Type: "counter", Value: 2}, {Name: "Alloc", Type: "gauge", Value: 0.5}}
+	require.NoError(t, c.SendMetricsBatch(context.Background(), d))
+
+	m, err := repo.GetMetric(context.Background(), "gauge", "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0.5, *m.Value)
+
+	// A server without the private key cannot read the body.
+	plain := httptest.NewServer(router.NewRouter(repo, router.WithKey(key)))
+	t.Cleanup(plain.Close)
+	c.Config.Address = strings.TrimPrefix(plain.URL, "http://")
+	assert.Error(t, c.SendMetricsBatch(context.Background(), d))
+}
+
+func TestClient_TLS(t *testing.T) {
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	ts := httptest.NewTLSServer(router.NewRouter(repo))
+	t.Cleanup(ts.Close)
+
+	caFile := filepath.Join(t.TempDir(), "ca.crt")
+	require.NoError(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644))
+
+	c, err := NewHTTPClient(&Agent{
+		Address:          strings.TrimPrefix(ts.URL, "https://"),
+		RetryMaxAttempts: 1,
+		GzipThreshold:    -1,
+		TLSCA:            caFile,
+		TLSServerName:    "example.com",
+	})
+	require.NoError(t, err)
+
+	d := []metrics.Data{{Name: "Alloc", Type: "gauge", Value: 1}}
+	require.NoError(t, c.SendMetricsBatch(context.Background(), d))
+
+	c, err = NewHTTPClient(&Agent{
+		Address:          strings.TrimPrefix(ts.URL, "https://"),
+		RetryMaxAttempts: 1,
+		GzipThreshold:    -1,
+		TLSCA:            caFile,
+		TLSServerName:    "other.test",
+	})
+	require.NoError(t, err)
+	assert.Error(t, c.SendMetricsBatch(context.Background(), d))
+}
+
+func TestClient_TrustedSubnet(t *testing.T) {
+	send := func(cidr string) error {
+		_, subnet, err := net.ParseCIDR(cidr)
+		require.NoError(t, err)
+		repo := storage.NewMemStorage(storage.DefaultHistorySize)
+		ts := httptest.NewServer(router.NewRouter(repo, router.WithTrustedSubnet(subnet)))
+		t.Cleanup(ts.Close)
+
+		c, err := NewHTTPClient(&Agent{
+			Address:          strings.TrimPrefix(ts.URL, "http://"),
+			RetryMaxAttempts: 1,
+		})
+		require.NoError(t, err)
+		return c.SendMetricsBatch(context.Background(), []metrics.Data{{Name: "Alloc", Type: "gauge", Value: 1}})
+	}
+
+	assert.NoError(t, send("127.0.0.0/8"))
+
+	var statusErr *StatusError
+	require.ErrorAs(t, send("10.0.0.0/8"), &statusErr)
+	assert.Equal(t, http.StatusForbidden, statusErr.StatusCode)
+}
+
+func TestClient_GRPC(t *testing.T) {
+	const key = "secret"
+	_, subnet, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	s := rpc.NewServer(repo, rpc.WithKey(key), rpc.WithTrustedSubnet(subnet))
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	c, err := NewHTTPClient(&Agent{
+		Key:              key,
+		SignatureVersion: metrics.SignatureCanonical,
+		RetryMaxAttempts: 3,
+		Transport:        "grpc",
+		GRPCAddress:      l.Addr().String(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+
+	d := []metrics.Data{{Name: "PollCount", Type: "counter", Value: 2}, {Name: "Alloc", Type: "gauge", Value: 0.5}}
+	require.NoError(t, c.SendMetricsBatch(context.Background(), d))
+	require.NoError(t, c.SendMetrics(context.Background(), d))
+
+	m, err := repo.GetMetric(context.Background(), "counter", "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *m.Delta)
+
+	// Signature errors are not retried.
+	c.Collect(context.Background())
+	c.Config.Key = "other"
+	err = c.SendMetricsBatch(context.Background(), d)
+	require.Error(t, err)
+	assert.Empty(t, Unsent(err, d))
+	assert.Len(t, Rejected(err, d), 2)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&c.stats.attempts))
+}
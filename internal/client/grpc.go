@@ -0,0 +1,56 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"strconv"
+)
+
+// dialGRPC connects to the metrics service at addr, over TLS when tlsConfig
+// is set. The connection is established lazily on the first call.
+func dialGRPC(addr string, tlsConfig *tls.Config) (*grpc.ClientConn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	return grpc.Dial(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(rpc.CodecName)),
+	)
+}
+
+func (c *Client) updateMetricRPC(ctx context.Context, d metrics.Data) error {
+	m := c.toMetrics(d)
+	return c.withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.rpc.UpdateMetric(c.rpcContext(ctx), &m)
+		return err
+	})
+}
+
+func (c *Client) updateMetricsBatchRPC(ctx context.Context, d []metrics.Data) error {
+	m := make([]metrics.Metrics, len(d))
+	for i, v := range d {
+		m[i] = c.toMetrics(v)
+	}
+	return c.withRetry(ctx, func(ctx context.Context) error {
+		_, err := c.rpc.UpdateMetricsBatch(c.rpcContext(ctx), m)
+		return err
+	})
+}
+
+// rpcContext adds the metadata the HTTP transport sends as headers.
+func (c *Client) rpcContext(ctx context.Context) context.Context {
+	if c.Config.Key != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, rpc.SignatureVersionKey, strconv.Itoa(c.Config.SignatureVersion))
+	}
+	if ip := c.realIP(); ip != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, rpc.RealIPKey, ip)
+	}
+	return ctx
+}
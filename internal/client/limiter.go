@@ -0,0 +1,64 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket limits the rate of requests. It holds up to burst tokens that
+// refill at rate tokens per second; every request takes one token. A
+// non-positive rate disables the limit.
+type TokenBucket struct {
+	mux    sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Wait blocks until a token is available or ctx is done.
+func (b *TokenBucket) Wait(ctx context.Context) error {
+	if b.rate <= 0 {
+		return nil
+	}
+	for {
+		wait := b.reserve(time.Now())
+		if wait == 0 {
+			return nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		}
+	}
+}
+
+// reserve takes a token and returns zero or returns how long to wait for the
+// next one.
+func (b *TokenBucket) reserve(now time.Time) time.Duration {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
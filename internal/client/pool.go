@@ -0,0 +1,122 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"sync"
+)
+
+// BatchError is returned when some of the metrics of a send were not
+// delivered. Unsent holds exactly those that may be retried, so they can be
+// sent again without sending the delivered counters twice. Rejected holds
+// those the server refused for good, which retrying cannot deliver.
+type BatchError struct {
+	Unsent   []metrics.Data
+	Rejected []metrics.Data
+	Err      error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d metrics not sent: %v", len(e.Unsent)+len(e.Rejected), e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// Unsent returns the metrics of d that were not delivered because of err and
+// may be retried.
+func Unsent(err error, d []metrics.Data) []metrics.Data {
+	if err == nil {
+		return nil
+	}
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return batchErr.Unsent
+	}
+	if IsRejected(err) {
+		return nil
+	}
+	return d
+}
+
+// Rejected returns the metrics of d the server refused for good.
+func Rejected(err error, d []metrics.Data) []metrics.Data {
+	if err == nil {
+		return nil
+	}
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return batchErr.Rejected
+	}
+	if IsRejected(err) {
+		return d
+	}
+	return nil
+}
+
+// dispatch sends the chunks on up to RateLimit workers. Requests made by
+// concurrent dispatches share the same limit, which is enforced in postOnce.
+func (c *Client) dispatch(ctx context.Context, chunks [][]metrics.Data, send func(ctx context.Context, d []metrics.Data) error) error {
+	workers := cap(c.slots)
+	if workers > len(chunks) {
+		workers = len(chunks)
+	}
+
+	var (
+		mux      sync.Mutex
+		unsent   []metrics.Data
+		rejected []metrics.Data
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	jobs := make(chan []metrics.Data)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range jobs {
+				if err := send(ctx, d); err != nil {
+					mux.Lock()
+					if IsRejected(err) {
+						rejected = append(rejected, d...)
+					} else {
+						unsent = append(unsent, d...)
+					}
+					if firstErr == nil {
+						firstErr = err
+					}
+					mux.Unlock()
+				}
+			}
+		}()
+	}
+	for _, d := range chunks {
+		jobs <- d
+	}
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return &BatchError{Unsent: unsent, Rejected: rejected, Err: firstErr}
+	}
+	return nil
+}
+
+// split cuts d into chunks of at most size metrics.
+func split(d []metrics.Data, size int) [][]metrics.Data {
+	if size <= 0 {
+		size = len(d)
+	}
+	var chunks [][]metrics.Data
+	for len(d) > size {
+		chunks = append(chunks, d[:size])
+		d = d[size:]
+	}
+	if len(d) > 0 {
+		chunks = append(chunks, d)
+	}
+	return chunks
+}
@@ -0,0 +1,152 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultRetryableStatuses are the response codes that indicate the server is
+// temporarily unable to handle the request.
+var DefaultRetryableStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// DefaultRetryableCodes are the gRPC counterparts of
+// DefaultRetryableStatuses.
+var DefaultRetryableCodes = []codes.Code{
+	codes.ResourceExhausted,
+	codes.Unavailable,
+}
+
+// RetryPolicy controls how requests are retried. The delay starts at
+// BaseDelay and doubles after every failed attempt up to MaxDelay; Jitter is
+// the fraction of the delay that is randomized so a fleet of agents does not
+// retry in lockstep. A Retry-After header replaces the computed delay, still
+// capped at MaxDelay.
+type RetryPolicy struct {
+	MaxAttempts       int
+	BaseDelay         time.Duration
+	MaxDelay          time.Duration
+	Jitter            float64
+	RetryableStatuses []int
+	RetryableCodes    []codes.Code
+}
+
+// StatusError is returned for responses with an unexpected status code.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	RetryAfter time.Duration
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.Status)
+}
+
+// rejectedCodes are the gRPC codes of requests the server refuses for good.
+var rejectedCodes = []codes.Code{
+	codes.InvalidArgument,
+	codes.NotFound,
+	codes.FailedPrecondition,
+	codes.PermissionDenied,
+	codes.Unauthenticated,
+	codes.Unimplemented,
+}
+
+// IsRejected reports whether err is a response refusing the request for good,
+// e.g. for a bad signature or an address outside the trusted subnet, so that
+// sending the same metrics again cannot succeed.
+func IsRejected(err error) bool {
+	if s, ok := status.FromError(err); ok {
+		for _, code := range rejectedCodes {
+			if s.Code() == code {
+				return true
+			}
+		}
+		return false
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		return false
+	}
+	switch statusErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	case http.StatusNotImplemented:
+		return true
+	}
+	return statusErr.StatusCode >= 400 && statusErr.StatusCode < 500
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if s, ok := status.FromError(err); ok {
+		for _, code := range p.RetryableCodes {
+			if s.Code() == code {
+				return true
+			}
+		}
+		return false
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		// Transport errors such as refused connections.
+		return true
+	}
+	for _, code := range p.RetryableStatuses {
+		if statusErr.StatusCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait before the attempt following attempt.
+func (p RetryPolicy) delay(attempt int, err error) time.Duration {
+	d := p.BaseDelay
+	for i := 1; i < attempt && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+	if p.Jitter > 0 {
+		d += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(d))
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.RetryAfter > 0 {
+		d = statusErr.RetryAfter
+	}
+	if p.MaxDelay > 0 && d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as an HTTP
+// date.
+func parseRetryAfter(v string, now time.Time) time.Duration {
+	if v == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		return t.Sub(now)
+	}
+	return 0
+}
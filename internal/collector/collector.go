@@ -0,0 +1,207 @@
+package collector
+
+import (
+	"context"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Collector gathers a group of metrics. Collect may be called again while a
+// previous call that ran past its timeout is still in progress.
+type Collector interface {
+	Name() string
+	Collect(ctx context.Context) ([]metrics.Data, error)
+}
+
+// Config enables a registered collector and sets how often it runs.
+type Config struct {
+	Name     string
+	Interval time.Duration
+}
+
+type Registry struct {
+	mux        sync.RWMutex
+	collectors map[string]Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{collectors: map[string]Collector{}}
+}
+
+// NewDefaultRegistry returns a registry with the runtime collector and, where
+// supported, the host collectors.
+func NewDefaultRegistry() *Registry {
+	r := NewRegistry()
+	r.MustRegister(NewRuntimeCollector())
+	for _, c := range hostCollectors() {
+		r.MustRegister(c)
+	}
+	return r
+}
+
+func (r *Registry) Register(c Collector) error {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	if _, ok := r.collectors[c.Name()]; ok {
+		return fmt.Errorf("collector %q is already registered", c.Name())
+	}
+	r.collectors[c.Name()] = c
+	return nil
+}
+
+func (r *Registry) MustRegister(c Collector) {
+	if err := r.Register(c); err != nil {
+		panic(err)
+	}
+}
+
+func (r *Registry) Get(name string) (Collector, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	c, ok := r.collectors[name]
+	return c, ok
+}
+
+// Names returns the names of the registered collectors in sorted order.
+func (r *Registry) Names() []string {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Configure parses specs such as "runtime,cpu:10s,disk:1m" or "-network".
+// Listed collectors are enabled, optionally with their own interval; entries
+// prefixed with "-" are disabled. Without enabled entries every registered
+// collector is enabled. Collectors without an interval run every interval.
+func (r *Registry) Configure(spec string, interval time.Duration) ([]Config, error) {
+	enabled := map[string]time.Duration{}
+	disabled := map[string]bool{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if name := strings.TrimPrefix(part, "-"); name != part {
+			if _, ok := r.Get(name); !ok {
+				return nil, fmt.Errorf("unknown collector %q", name)
+			}
+			disabled[name] = true
+			continue
+		}
+
+		name, value, ok := strings.Cut(part, ":")
+		if _, found := r.Get(name); !found {
+			return nil, fmt.Errorf("unknown collector %q", name)
+		}
+		d := interval
+		if ok {
+			var err error
+			if d, err = time.ParseDuration(value); err != nil || d <= 0 {
+				return nil, fmt.Errorf("invalid collector interval %q", part)
+			}
+		}
+		enabled[name] = d
+	}
+
+	if len(enabled) == 0 {
+		for _, name := range r.Names() {
+			enabled[name] = interval
+		}
+	}
+
+	var result []Config
+	for _, name := range r.Names() {
+		if d, ok := enabled[name]; ok && !disabled[name] {
+			result = append(result, Config{Name: name, Interval: d})
+		}
+	}
+	return result, nil
+}
+
+// Run starts every configured collector in its own goroutine and sends what
+// they collect to ch until ctx is done. Each collection is bounded by
+// timeout; a collector that fails, times out or panics is logged and does
+// not affect the others.
+func (r *Registry) Run(ctx context.Context, cfg []Config, timeout time.Duration, ch chan<- []metrics.Data) error {
+	var wg sync.WaitGroup
+	for _, cc := range cfg {
+		c, ok := r.Get(cc.Name)
+		if !ok {
+			return fmt.Errorf("unknown collector %q", cc.Name)
+		}
+		interval := cc.Interval
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			t := time.NewTicker(interval)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-t.C:
+					d, err := collect(ctx, c, timeout)
+					if err != nil {
+						log.Printf("collector %s: %v\n", c.Name(), err)
+					}
+					if len(d) == 0 {
+						continue
+					}
+					select {
+					case ch <- d:
+					case <-ctx.Done():
+						return
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func collect(ctx context.Context, c Collector, timeout time.Duration) ([]metrics.Data, error) {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	type result struct {
+		d   []metrics.Data
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{err: fmt.Errorf("panic: %v", p)}
+			}
+		}()
+		d, err := c.Collect(ctx)
+		done <- result{d, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.d, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,92 @@
+package collector
+
+import (
+	"context"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+type funcCollector struct {
+	name    string
+	collect func(ctx context.Context) ([]metrics.Data, error)
+}
+
+func (c funcCollector) Name() string {
+	return c.name
+}
+
+func (c funcCollector) Collect(ctx context.Context) ([]metrics.Data, error) {
+	return c.collect(ctx)
+}
+
+func TestRegistry_Configure(t *testing.T) {
+	r := NewRegistry()
+	for _, name := range []string{"cpu", "memory", "runtime"} {
+		require.NoError(t, r.Register(funcCollector{name: name}))
+	}
+	assert.Error(t, r.Register(funcCollector{name: "cpu"}))
+
+	tests := []struct {
+		spec    string
+		want    []Config
+		wantErr bool
+	}{
+		{spec: "", want: []Config{{"cpu", time.Second}, {"memory", time.Second}, {"runtime", time.Second}}},
+		{spec: "runtime,cpu:10s", want: []Config{{"cpu", 10 * time.Second}, {"runtime", time.Second}}},
+		{spec: "-memory", want: []Config{{"cpu", time.Second}, {"runtime", time.Second}}},
+		{spec: "gpu", wantErr: true},
+		{spec: "cpu:fast", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			cfg, err := r.Configure(tt.spec, time.Second)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, cfg)
+		})
+	}
+}
+
+func TestRegistry_RunIsolatesCollectors(t *testing.T) {
+	r := NewRegistry()
+	r.MustRegister(funcCollector{name: "ok", collect: func(context.Context) ([]metrics.Data, error) {
+		return []metrics.Data{{Name: "Up", Type: "gauge", Value: 1}}, nil
+	}})
+	r.MustRegister(funcCollector{name: "failing", collect: func(context.Context) ([]metrics.Data, error) {
+		return nil, errors.New("boom")
+	}})
+	r.MustRegister(funcCollector{name: "panicking", collect: func(context.Context) ([]metrics.Data, error) {
+		panic("boom")
+	}})
+	r.MustRegister(funcCollector{name: "stuck", collect: func(context.Context) ([]metrics.Data, error) {
+		select {}
+	}})
+
+	cfg, err := r.Configure("", 10*time.Millisecond)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan []metrics.Data)
+	done := make(chan error)
+	go func() {
+		done <- r.Run(ctx, cfg, 20*time.Millisecond, ch)
+	}()
+
+	for i := 0; i < 3; i++ {
+		select {
+		case d := <-ch:
+			assert.Equal(t, "Up", d[0].Name)
+		case <-time.After(time.Second):
+			t.Fatal("no metrics collected")
+		}
+	}
+	cancel()
+	assert.NoError(t, <-done)
+}
@@ -0,0 +1,409 @@
+//go:build linux
+
+package collector
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const sectorSize = 512
+
+// virtualFS lists filesystems that do not hold data on a disk.
+var virtualFS = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true,
+	"configfs": true, "debugfs": true, "devpts": true, "devtmpfs": true, "fusectl": true,
+	"hugetlbfs": true, "mqueue": true, "nsfs": true, "proc": true, "pstore": true,
+	"securityfs": true, "sysfs": true, "tmpfs": true, "tracefs": true, "ramfs": true,
+}
+
+// hostCollectors returns the collectors of the host metrics:
+//
+//   - cpu: CPUUtilization, CPUUtilization.<core> (percent)
+//   - memory: TotalMemory, FreeMemory, AvailableMemory, UsedMemory,
+//     TotalSwap, FreeSwap, UsedSwap (bytes)
+//   - load: LoadAverage1, LoadAverage5, LoadAverage15
+//   - disk: DiskTotal.<mount>, DiskFree.<mount>, DiskUsed.<mount> (bytes),
+//     where / is named root and /var/lib is named var_lib
+//   - diskio: DiskReads.<device>, DiskWrites.<device>,
+//     DiskReadBytes.<device>, DiskWriteBytes.<device> (counters)
+//   - network: NetReceivedBytes.<iface>, NetSentBytes.<iface>,
+//     NetReceivedPackets.<iface>, NetSentPackets.<iface>,
+//     NetReceiveErrors.<iface>, NetSendErrors.<iface> (counters)
+//
+// The kernel exposes cumulative counters, so counters are reported as the
+// increase since the previous collection and CPU utilization needs two
+// collections before it is reported.
+func hostCollectors() []Collector {
+	return []Collector{
+		NewCPUCollector("/proc"),
+		NewMemoryCollector("/proc"),
+		NewLoadCollector("/proc"),
+		NewDiskCollector("/proc"),
+		NewDiskIOCollector("/proc", "/sys"),
+		NewNetworkCollector("/proc"),
+	}
+}
+
+type cpuTimes struct {
+	idle  float64
+	total float64
+}
+
+type CPUCollector struct {
+	mux      sync.Mutex
+	procPath string
+	prev     map[string]cpuTimes
+}
+
+func NewCPUCollector(procPath string) *CPUCollector {
+	return &CPUCollector{procPath: procPath, prev: map[string]cpuTimes{}}
+}
+
+func (c *CPUCollector) Name() string {
+	return "cpu"
+}
+
+func (c *CPUCollector) Collect(_ context.Context) ([]metrics.Data, error) {
+	lines, err := readLines(filepath.Join(c.procPath, "stat"))
+	if err != nil {
+		return nil, err
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	var d []metrics.Data
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		// user nice system idle iowait irq softirq steal; guest time is
+		// already accounted in user.
+		var t cpuTimes
+		for i, f := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid cpu stat %q: %w", line, err)
+			}
+			t.total += v
+			if i == 3 || i == 4 {
+				t.idle += v
+			}
+		}
+
+		name := "CPUUtilization"
+		if core := strings.TrimPrefix(fields[0], "cpu"); core != "" {
+			name += "." + core
+		}
+		prev, ok := c.prev[name]
+		c.prev[name] = t
+		if !ok || t.total <= prev.total {
+			continue
+		}
+		d = gauge(d, name, 100*(1-(t.idle-prev.idle)/(t.total-prev.total)))
+	}
+	return d, nil
+}
+
+type MemoryCollector struct {
+	procPath string
+}
+
+func NewMemoryCollector(procPath string) *MemoryCollector {
+	return &MemoryCollector{procPath: procPath}
+}
+
+func (c *MemoryCollector) Name() string {
+	return "memory"
+}
+
+func (c *MemoryCollector) Collect(_ context.Context) ([]metrics.Data, error) {
+	lines, err := readLines(filepath.Join(c.procPath, "meminfo"))
+	if err != nil {
+		return nil, err
+	}
+	info := map[string]float64{}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		v, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil {
+			continue
+		}
+		if len(fields) == 3 && fields[2] == "kB" {
+			v *= 1024
+		}
+		info[strings.TrimSuffix(fields[0], ":")] = v
+	}
+
+	var d []metrics.Data
+	d = gauge(d, "TotalMemory", info["MemTotal"])
+	d = gauge(d, "FreeMemory", info["MemFree"])
+	d = gauge(d, "AvailableMemory", info["MemAvailable"])
+	d = gauge(d, "UsedMemory", info["MemTotal"]-info["MemAvailable"])
+	d = gauge(d, "TotalSwap", info["SwapTotal"])
+	d = gauge(d, "FreeSwap", info["SwapFree"])
+	d = gauge(d, "UsedSwap", info["SwapTotal"]-info["SwapFree"])
+	return d, nil
+}
+
+type LoadCollector struct {
+	procPath string
+}
+
+func NewLoadCollector(procPath string) *LoadCollector {
+	return &LoadCollector{procPath: procPath}
+}
+
+func (c *LoadCollector) Name() string {
+	return "load"
+}
+
+func (c *LoadCollector) Collect(_ context.Context) ([]metrics.Data, error) {
+	b, err := os.ReadFile(filepath.Join(c.procPath, "loadavg"))
+	if err != nil {
+		return nil, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 3 {
+		return nil, fmt.Errorf("invalid loadavg %q", b)
+	}
+
+	var d []metrics.Data
+	for i, name := range []string{"LoadAverage1", "LoadAverage5", "LoadAverage15"} {
+		v, err := strconv.ParseFloat(fields[i], 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loadavg %q: %w", b, err)
+		}
+		d = gauge(d, name, v)
+	}
+	return d, nil
+}
+
+type DiskCollector struct {
+	procPath string
+}
+
+func NewDiskCollector(procPath string) *DiskCollector {
+	return &DiskCollector{procPath: procPath}
+}
+
+func (c *DiskCollector) Name() string {
+	return "disk"
+}
+
+func (c *DiskCollector) Collect(ctx context.Context) ([]metrics.Data, error) {
+	lines, err := readLines(filepath.Join(c.procPath, "mounts"))
+	if err != nil {
+		return nil, err
+	}
+
+	var d []metrics.Data
+	devices := map[string]bool{}
+	for _, line := range lines {
+		// Statfs can block on unresponsive network mounts.
+		if err := ctx.Err(); err != nil {
+			return d, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 || virtualFS[fields[2]] || devices[fields[0]] {
+			continue
+		}
+		devices[fields[0]] = true
+
+		mount := fields[1]
+		var st syscall.Statfs_t
+		if err := syscall.Statfs(mount, &st); err != nil {
+			continue
+		}
+		name := mountName(mount)
+		total := float64(st.Blocks) * float64(st.Bsize)
+		d = gauge(d, "DiskTotal."+name, total)
+		d = gauge(d, "DiskFree."+name, float64(st.Bavail)*float64(st.Bsize))
+		d = gauge(d, "DiskUsed."+name, total-float64(st.Bfree)*float64(st.Bsize))
+	}
+	return d, nil
+}
+
+type DiskIOCollector struct {
+	procPath string
+	sysPath  string
+	counters *deltas
+}
+
+func NewDiskIOCollector(procPath, sysPath string) *DiskIOCollector {
+	return &DiskIOCollector{procPath: procPath, sysPath: sysPath, counters: newDeltas()}
+}
+
+func (c *DiskIOCollector) Name() string {
+	return "diskio"
+}
+
+func (c *DiskIOCollector) Collect(_ context.Context) ([]metrics.Data, error) {
+	lines, err := readLines(filepath.Join(c.procPath, "diskstats"))
+	if err != nil {
+		return nil, err
+	}
+
+	c.counters.mux.Lock()
+	defer c.counters.mux.Unlock()
+
+	var d []metrics.Data
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+		device := fields[2]
+		// Only whole block devices are listed in /sys/block, which skips
+		// partitions that would be counted twice.
+		if _, err := os.Stat(filepath.Join(c.sysPath, "block", device)); err != nil {
+			continue
+		}
+		if strings.HasPrefix(device, "loop") || strings.HasPrefix(device, "ram") {
+			continue
+		}
+
+		var v [4]float64
+		for i, idx := range []int{3, 5, 7, 9} {
+			if v[i], err = strconv.ParseFloat(fields[idx], 64); err != nil {
+				return nil, fmt.Errorf("invalid diskstats %q: %w", line, err)
+			}
+		}
+		name := sanitizeName(device)
+		d = c.counters.add(d, "DiskReads."+name, v[0])
+		d = c.counters.add(d, "DiskReadBytes."+name, v[1]*sectorSize)
+		d = c.counters.add(d, "DiskWrites."+name, v[2])
+		d = c.counters.add(d, "DiskWriteBytes."+name, v[3]*sectorSize)
+	}
+	return d, nil
+}
+
+type NetworkCollector struct {
+	procPath string
+	counters *deltas
+}
+
+func NewNetworkCollector(procPath string) *NetworkCollector {
+	return &NetworkCollector{procPath: procPath, counters: newDeltas()}
+}
+
+func (c *NetworkCollector) Name() string {
+	return "network"
+}
+
+func (c *NetworkCollector) Collect(_ context.Context) ([]metrics.Data, error) {
+	lines, err := readLines(filepath.Join(c.procPath, "net", "dev"))
+	if err != nil {
+		return nil, err
+	}
+
+	c.counters.mux.Lock()
+	defer c.counters.mux.Unlock()
+
+	var d []metrics.Data
+	for _, line := range lines {
+		iface, stats, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		iface = strings.TrimSpace(iface)
+		fields := strings.Fields(stats)
+		if iface == "lo" || len(fields) < 11 {
+			continue
+		}
+
+		var v [6]float64
+		for i, idx := range []int{0, 1, 2, 8, 9, 10} {
+			if v[i], err = strconv.ParseFloat(fields[idx], 64); err != nil {
+				return nil, fmt.Errorf("invalid net/dev %q: %w", line, err)
+			}
+		}
+		d = c.counters.add(d, "NetReceivedBytes."+iface, v[0])
+		d = c.counters.add(d, "NetReceivedPackets."+iface, v[1])
+		d = c.counters.add(d, "NetReceiveErrors."+iface, v[2])
+		d = c.counters.add(d, "NetSentBytes."+iface, v[3])
+		d = c.counters.add(d, "NetSentPackets."+iface, v[4])
+		d = c.counters.add(d, "NetSendErrors."+iface, v[5])
+	}
+	return d, nil
+}
+
+// deltas turns cumulative counters into the increase since the previous
+// collection.
+type deltas struct {
+	mux  sync.Mutex
+	prev map[string]float64
+}
+
+func newDeltas() *deltas {
+	return &deltas{prev: map[string]float64{}}
+}
+
+// add appends the increase of a counter. The first value only becomes the
+// baseline; a decrease is treated as a counter reset.
+func (c *deltas) add(d []metrics.Data, name string, value float64) []metrics.Data {
+	prev, ok := c.prev[name]
+	c.prev[name] = value
+	if !ok {
+		return d
+	}
+	delta := value - prev
+	if delta < 0 {
+		delta = value
+	}
+	return append(d, metrics.Data{Name: name, Type: "counter", Value: delta})
+}
+
+// mountName turns a mount point into a metric name suffix.
+func mountName(mount string) string {
+	if mount = strings.Trim(mount, "/"); mount == "" {
+		return "root"
+	}
+	return sanitizeName(mount)
+}
+
+// sanitizeName replaces the characters of s that are not allowed in metric
+// ids, such as the slashes of paths, with underscores.
+func sanitizeName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
+
+func gauge(d []metrics.Data, name string, value float64) []metrics.Data {
+	return append(d, metrics.Data{Name: name, Type: "gauge", Value: value})
+}
+
+func readLines(fileName string) ([]string, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	return lines, scanner.Err()
+}
@@ -0,0 +1,101 @@
+//go:build linux
+
+package collector
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeProc(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+}
+
+func collectAll(t *testing.T, cs []Collector) (map[string]float64, map[string]string) {
+	values, types := map[string]float64{}, map[string]string{}
+	for _, c := range cs {
+		d, err := c.Collect(context.Background())
+		require.NoError(t, err, c.Name())
+		for _, v := range d {
+			values[v.Name] = v.Value
+			types[v.Name] = v.Type
+		}
+	}
+	return values, types
+}
+
+func TestHostCollectors(t *testing.T) {
+	dir := t.TempDir()
+	procPath, sysPath := filepath.Join(dir, "proc"), filepath.Join(dir, "sys")
+	require.NoError(t, os.MkdirAll(filepath.Join(sysPath, "block", "sda"), 0755))
+
+	cs := []Collector{
+		NewCPUCollector(procPath),
+		NewMemoryCollector(procPath),
+		NewLoadCollector(procPath),
+		NewDiskCollector(procPath),
+		NewDiskIOCollector(procPath, sysPath),
+		NewNetworkCollector(procPath),
+	}
+
+	writeProc(t, procPath, map[string]string{
+		"stat":      "cpu  100 0 100 800 0 0 0 0 0 0\ncpu0 100 0 100 800 0 0 0 0 0 0\nintr 1\n",
+		"meminfo":   "MemTotal: 1000 kB\nMemFree: 200 kB\nMemAvailable: 600 kB\nSwapTotal: 100 kB\nSwapFree: 100 kB\n",
+		"loadavg":   "0.50 0.25 0.10 1/100 42\n",
+		"mounts":    "proc /proc proc rw 0 0\n",
+		"diskstats": "   8       0 sda 10 0 20 0 5 0 40 0 0 0 0\n   8       1 sda1 10 0 20 0 5 0 40 0 0 0 0\n",
+		"net/dev":   "Inter-|   Receive\n face |bytes packets errs\n    lo: 1 1 0 0 0 0 0 0 1 1 0 0 0 0 0 0\n  eth0: 100 10 1 0 0 0 0 0 50 5 0 0 0 0 0 0\n",
+	})
+	values, _ := collectAll(t, cs)
+	assert.Equal(t, float64(1000*1024), values["TotalMemory"])
+	assert.Equal(t, float64(400*1024), values["UsedMemory"])
+	assert.Equal(t, 0.25, values["LoadAverage5"])
+	assert.NotContains(t, values, "CPUUtilization")
+	assert.NotContains(t, values, "DiskReads.sda")
+
+	writeProc(t, procPath, map[string]string{
+		"stat":      "cpu  150 0 150 900 0 0 0 0 0 0\ncpu0 150 0 150 900 0 0 0 0 0 0\n",
+		"diskstats": "   8       0 sda 15 0 30 0 5 0 40 0 0 0 0\n   8       1 sda1 15 0 30 0 5 0 40 0 0 0 0\n",
+		"net/dev":   "  eth0: 300 20 1 0 0 0 0 0 50 5 0 0 0 0 0 0\n",
+	})
+	values, types := collectAll(t, cs)
+	assert.Equal(t, 50.0, values["CPUUtilization"])
+	assert.Equal(t, 50.0, values["CPUUtilization.0"])
+	assert.Equal(t, 5.0, values["DiskReads.sda"])
+	assert.Equal(t, float64(10*sectorSize), values["DiskReadBytes.sda"])
+	assert.NotContains(t, values, "DiskReads.sda1")
+	assert.Equal(t, 200.0, values["NetReceivedBytes.eth0"])
+	assert.Equal(t, 0.0, values["NetSentBytes.eth0"])
+	assert.Equal(t, "counter", types["NetReceivedBytes.eth0"])
+	assert.NotContains(t, values, "NetReceivedBytes.lo")
+}
+
+func TestDiskCollector(t *testing.T) {
+	procPath := t.TempDir()
+	writeProc(t, procPath, map[string]string{
+		"mounts": "/dev/sda1 / ext4 rw 0 0\n/dev/sda2 " + procPath + " ext4 rw 0 0\n",
+	})
+
+	values, _ := collectAll(t, []Collector{NewDiskCollector(procPath)})
+	assert.Contains(t, values, "DiskTotal.root")
+	assert.Contains(t, values, "DiskFree."+mountName(procPath))
+	for name := range values {
+		assert.NotContains(t, name, "/")
+	}
+}
+
+func TestMountName(t *testing.T) {
+	assert.Equal(t, "root", mountName("/"))
+	assert.Equal(t, "home", mountName("/home"))
+	assert.Equal(t, "var_lib_docker", mountName("/var/lib/docker/"))
+	assert.Equal(t, "mnt_my_040disk", mountName(`/mnt/my\040disk`))
+	assert.Equal(t, "cciss_c0d0", sanitizeName("cciss/c0d0"))
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package collector
+
+// hostCollectors returns no collectors as host metrics are only read on Linux.
+func hostCollectors() []Collector {
+	return nil
+}
@@ -37,18 +37,112 @@ func NewClient(ctx context.Context, maxAttempt int, dsn string) (conn *pgxpool.P
 	return
 }
 
+// createTable creates the metrics table. A series is identified by its id,
+// type and labels; tables created before labels existed were keyed by id
+// alone and are migrated in place.
 func createTable(conn *pgxpool.Pool) error {
-	_, err := conn.Exec(context.Background(), `
-        CREATE TABLE IF NOT EXISTS metrics (
-            id TEXT PRIMARY KEY,
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS metrics (
+            id TEXT NOT NULL,
             type TEXT NOT NULL,
+            labels JSONB NOT NULL DEFAULT '{}',
             delta BIGINT,
             value DOUBLE PRECISION,
+            histogram JSONB,
             hash TEXT
+        )`,
+		`ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE metrics ADD COLUMN IF NOT EXISTS histogram JSONB`,
+		`ALTER TABLE metrics DROP CONSTRAINT IF EXISTS metrics_pkey`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS metrics_series_idx
+            ON metrics (id, type, labels)`,
+	} {
+		if _, err := conn.Exec(context.Background(), q); err != nil {
+			return fmt.Errorf("failed to create table: %w", err)
+		}
+	}
+	if err := createSamplesTable(conn); err != nil {
+		return err
+	}
+	if err := createRollupsTable(conn); err != nil {
+		return err
+	}
+	if err := createSilencesTable(conn); err != nil {
+		return err
+	}
+	return nil
+}
+
+// createSamplesTable creates the history table. Samples are appended in time
+// order, so a BRIN index on ts keeps range scans cheap on large tables. The
+// series index predates labels and is replaced by one that includes them.
+func createSamplesTable(conn *pgxpool.Pool) error {
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS metric_samples (
+            id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            labels JSONB NOT NULL DEFAULT '{}',
+            ts TIMESTAMPTZ NOT NULL,
+            value DOUBLE PRECISION NOT NULL
+        )`,
+		`ALTER TABLE metric_samples ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'`,
+		`DROP INDEX IF EXISTS metric_samples_series_idx`,
+		`CREATE INDEX IF NOT EXISTS metric_samples_series_labels_idx
+            ON metric_samples (id, type, labels, ts)`,
+		`CREATE INDEX IF NOT EXISTS metric_samples_ts_brin
+            ON metric_samples USING BRIN (ts)`,
+	} {
+		if _, err := conn.Exec(context.Background(), q); err != nil {
+			return fmt.Errorf("failed to create table metric_samples: %w", err)
+		}
+	}
+	return nil
+}
+
+// createRollupsTable creates the table holding downsampled history. The
+// resolution is stored in seconds; retention deletes by resolution and ts.
+func createRollupsTable(conn *pgxpool.Pool) error {
+	for _, q := range []string{
+		`CREATE TABLE IF NOT EXISTS metric_rollups (
+            id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            labels JSONB NOT NULL DEFAULT '{}',
+            resolution BIGINT NOT NULL,
+            ts TIMESTAMPTZ NOT NULL,
+            count BIGINT NOT NULL,
+            min DOUBLE PRECISION NOT NULL,
+            max DOUBLE PRECISION NOT NULL,
+            sum DOUBLE PRECISION NOT NULL,
+            last DOUBLE PRECISION NOT NULL
+        )`,
+		`ALTER TABLE metric_rollups ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}'`,
+		`ALTER TABLE metric_rollups DROP CONSTRAINT IF EXISTS metric_rollups_pkey`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS metric_rollups_series_idx
+            ON metric_rollups (id, type, labels, resolution, ts)`,
+		`CREATE INDEX IF NOT EXISTS metric_rollups_resolution_ts_idx
+            ON metric_rollups (resolution, ts)`,
+	} {
+		if _, err := conn.Exec(context.Background(), q); err != nil {
+			return fmt.Errorf("failed to create table metric_rollups: %w", err)
+		}
+	}
+	return nil
+}
+
+func createSilencesTable(conn *pgxpool.Pool) error {
+	_, err := conn.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS silences (
+            id TEXT PRIMARY KEY,
+            matchers JSONB NOT NULL,
+            starts_at TIMESTAMPTZ NOT NULL,
+            ends_at TIMESTAMPTZ NOT NULL,
+            author TEXT NOT NULL,
+            comment TEXT NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL
         )
     `)
 	if err != nil {
-		return fmt.Errorf("failed to create table: %w", err)
+		return fmt.Errorf("failed to create table silences: %w", err)
 	}
 	return nil
 }
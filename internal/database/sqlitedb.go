@@ -0,0 +1,203 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	_ "github.com/mattn/go-sqlite3"
+	"strings"
+)
+
+const SQLiteScheme = "sqlite://"
+
+// IsSQLiteDSN reports whether dsn points to a SQLite database file.
+func IsSQLiteDSN(dsn string) bool {
+	return strings.HasPrefix(dsn, SQLiteScheme)
+}
+
+// NewSQLiteClient opens the database file referenced by a sqlite:// DSN,
+// e.g. sqlite:///var/lib/alertics.db.
+func NewSQLiteClient(ctx context.Context, dsn string) (*sql.DB, error) {
+	path := strings.TrimPrefix(dsn, SQLiteScheme)
+	if path == "" {
+		return nil, fmt.Errorf("empty sqlite database path in dsn %q", dsn)
+	}
+
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer, so serialize access instead of
+	// fighting over the database lock.
+	db.SetMaxOpenConns(1)
+
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := createSQLiteTable(ctx, db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// createSQLiteTable creates the tables. Labels are stored in their canonical
+// form, with an empty string for series without labels.
+func createSQLiteTable(ctx context.Context, db *sql.DB) error {
+	if err := migrateSQLiteLabels(ctx, db); err != nil {
+		return err
+	}
+	_, err := db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS metrics (
+            id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            labels TEXT NOT NULL DEFAULT '',
+            delta BIGINT,
+            value DOUBLE PRECISION,
+            histogram TEXT,
+            hash TEXT,
+            PRIMARY KEY (id, type, labels)
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create table: %w", err)
+	}
+	histogram, err := hasColumn(ctx, db, "metrics", "histogram")
+	if err != nil {
+		return err
+	}
+	if !histogram {
+		if _, err := db.ExecContext(ctx, `ALTER TABLE metrics ADD COLUMN histogram TEXT`); err != nil {
+			return fmt.Errorf("failed to migrate table metrics: %w", err)
+		}
+	}
+	_, err = db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS metric_samples (
+            id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            labels TEXT NOT NULL DEFAULT '',
+            ts INTEGER NOT NULL,
+            value DOUBLE PRECISION NOT NULL
+        );
+        DROP INDEX IF EXISTS metric_samples_series_idx;
+        CREATE INDEX IF NOT EXISTS metric_samples_series_labels_idx
+            ON metric_samples (id, type, labels, ts);
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create table metric_samples: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS metric_rollups (
+            id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            labels TEXT NOT NULL DEFAULT '',
+            resolution INTEGER NOT NULL,
+            ts INTEGER NOT NULL,
+            count INTEGER NOT NULL,
+            min DOUBLE PRECISION NOT NULL,
+            max DOUBLE PRECISION NOT NULL,
+            sum DOUBLE PRECISION NOT NULL,
+            last DOUBLE PRECISION NOT NULL,
+            PRIMARY KEY (id, type, labels, resolution, ts)
+        );
+        CREATE INDEX IF NOT EXISTS metric_rollups_resolution_ts_idx
+            ON metric_rollups (resolution, ts);
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create table metric_rollups: %w", err)
+	}
+	_, err = db.ExecContext(ctx, `
+        CREATE TABLE IF NOT EXISTS silences (
+            id TEXT PRIMARY KEY,
+            matchers TEXT NOT NULL,
+            starts_at INTEGER NOT NULL,
+            ends_at INTEGER NOT NULL,
+            author TEXT NOT NULL,
+            comment TEXT NOT NULL,
+            created_at INTEGER NOT NULL
+        )
+    `)
+	if err != nil {
+		return fmt.Errorf("failed to create table silences: %w", err)
+	}
+	return nil
+}
+
+// migrateSQLiteLabels adds the labels column to tables created before series
+// were identified by their labels. SQLite cannot change a primary key, so the
+// metrics table is rebuilt.
+func migrateSQLiteLabels(ctx context.Context, db *sql.DB) error {
+	migrated, err := hasColumn(ctx, db, "metrics", "labels")
+	if err != nil || migrated {
+		return err
+	}
+	exists, err := hasColumn(ctx, db, "metrics", "id")
+	if err != nil || !exists {
+		return err
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, q := range []string{
+		`ALTER TABLE metrics RENAME TO metrics_old`,
+		`CREATE TABLE metrics (
+            id TEXT NOT NULL,
+            type TEXT NOT NULL,
+            labels TEXT NOT NULL DEFAULT '',
+            delta BIGINT,
+            value DOUBLE PRECISION,
+            hash TEXT,
+            PRIMARY KEY (id, type, labels)
+        )`,
+		`INSERT INTO metrics (id, type, delta, value, hash)
+            SELECT id, type, delta, value, hash FROM metrics_old`,
+		`DROP TABLE metrics_old`,
+	} {
+		if _, err := tx.ExecContext(ctx, q); err != nil {
+			return fmt.Errorf("failed to migrate table metrics: %w", err)
+		}
+	}
+
+	samples, err := hasColumn(ctx, tx, "metric_samples", "id")
+	if err != nil {
+		return err
+	}
+	if samples {
+		_, err := tx.ExecContext(ctx, `ALTER TABLE metric_samples ADD COLUMN labels TEXT NOT NULL DEFAULT ''`)
+		if err != nil {
+			return fmt.Errorf("failed to migrate table metric_samples: %w", err)
+		}
+	}
+	return tx.Commit()
+}
+
+// sqlQuerier is satisfied by both *sql.DB and *sql.Tx.
+type sqlQuerier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// hasColumn reports whether table has the named column; it is false for a
+// table that does not exist.
+func hasColumn(ctx context.Context, db sqlQuerier, table, column string) (bool, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name FROM pragma_table_info($1)`, table)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
@@ -0,0 +1,161 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header marks an encrypted request body; Scheme is its only value.
+const (
+	Header = "X-Content-Encryption"
+	Scheme = "rsa-oaep+aes-256-gcm"
+)
+
+var ErrInvalidEnvelope = errors.New("invalid encrypted body")
+
+// Encrypt seals plaintext with a random AES-256-GCM key that is wrapped with
+// RSA-OAEP for pub. The envelope is the big-endian length of the wrapped key,
+// the wrapped key, the GCM nonce and the ciphertext.
+func Encrypt(pub *rsa.PublicKey, plaintext []byte) ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 2, 2+len(wrapped)+len(nonce)+len(plaintext)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(wrapped)))
+	out = append(out, wrapped...)
+	out = append(out, nonce...)
+	return gcm.Seal(out, nonce, plaintext, nil), nil
+}
+
+// Decrypt opens an envelope produced by Encrypt.
+func Decrypt(priv *rsa.PrivateKey, envelope []byte) ([]byte, error) {
+	if len(envelope) < 2 {
+		return nil, ErrInvalidEnvelope
+	}
+	n := int(binary.BigEndian.Uint16(envelope))
+	envelope = envelope[2:]
+	if len(envelope) < n {
+		return nil, ErrInvalidEnvelope
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, envelope[:n], nil)
+	if err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	envelope = envelope[n:]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(envelope) < gcm.NonceSize() {
+		return nil, ErrInvalidEnvelope
+	}
+	plaintext, err := gcm.Open(nil, envelope[:gcm.NonceSize()], envelope[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrInvalidEnvelope
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadPublicKey reads an RSA public key from a PEM file holding a PKIX or
+// PKCS #1 public key or a certificate.
+func LoadPublicKey(fileName string) (*rsa.PublicKey, error) {
+	block, err := readPEM(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		if cert, err = x509.ParseCertificate(block.Bytes); err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", fileName, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA public key", fileName)
+	}
+	return pub, nil
+}
+
+// LoadPrivateKey reads an RSA private key from a PEM file in PKCS #1 or
+// PKCS #8 form.
+func LoadPrivateKey(fileName string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unexpected PEM block %q", fileName, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fileName, err)
+	}
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA private key", fileName)
+	}
+	return priv, nil
+}
+
+func readPEM(fileName string) (*pem.Block, error) {
+	b, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data", fileName)
+	}
+	return block, nil
+}
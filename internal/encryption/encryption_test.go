@@ -0,0 +1,47 @@
+package encryption
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	pubDER, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	require.NoError(t, err)
+	pubFile := filepath.Join(dir, "public.pem")
+	require.NoError(t, os.WriteFile(pubFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644))
+	privFile := filepath.Join(dir, "private.pem")
+	require.NoError(t, os.WriteFile(privFile, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0600))
+
+	pub, err := LoadPublicKey(pubFile)
+	require.NoError(t, err)
+	loaded, err := LoadPrivateKey(privFile)
+	require.NoError(t, err)
+
+	plaintext := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	envelope, err := Encrypt(pub, plaintext)
+	require.NoError(t, err)
+	assert.NotContains(t, string(envelope), "Alloc")
+
+	got, err := Decrypt(loaded, envelope)
+	require.NoError(t, err)
+	assert.Equal(t, plaintext, got)
+
+	envelope[len(envelope)-1] ^= 1
+	_, err = Decrypt(loaded, envelope)
+	assert.ErrorIs(t, err, ErrInvalidEnvelope)
+
+	_, err = Decrypt(loaded, []byte{0xff})
+	assert.ErrorIs(t, err, ErrInvalidEnvelope)
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/alerting"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+)
+
+// ListRules serves GET /api/v1/rules with the state of every alert rule.
+func ListRules(engine *alerting.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, engine.Rules())
+	}
+}
+
+// ListAlerts serves GET /api/v1/alerts. Alerts matched by an active silence
+// list the silence ids; silencer may be nil when silences are unsupported.
+func ListAlerts(engine *alerting.Engine, silencer *alerting.Silencer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		alerts := engine.Alerts()
+		if silencer != nil {
+			alerts = silencer.Apply(r.Context(), alerts)
+		}
+		writeJSON(w, alerts)
+	}
+}
+
+type ackRequest struct {
+	Author  string `json:"author"`
+	Comment string `json:"comment"`
+}
+
+func AcknowledgeAlert(engine *alerting.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req ackRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Author == "" {
+			http.Error(w, "author is empty", http.StatusBadRequest)
+			return
+		}
+
+		series, err := labelsFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, err := engine.Acknowledge(chi.URLParam(r, "rule"), series, req.Author, req.Comment)
+		if err != nil {
+			http.Error(w, err.Error(), alertStatusFromError(err))
+			return
+		}
+		writeJSON(w, a)
+	}
+}
+
+func UnacknowledgeAlert(engine *alerting.Engine) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		series, err := labelsFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		a, err := engine.Unacknowledge(chi.URLParam(r, "rule"), series)
+		if err != nil {
+			http.Error(w, err.Error(), alertStatusFromError(err))
+			return
+		}
+		writeJSON(w, a)
+	}
+}
+
+func alertStatusFromError(err error) int {
+	if errors.Is(err, alerting.ErrAlertNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -1,55 +1,73 @@
 package handlers
 
 import (
-	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"github.com/eugeniylennik/alertics/internal/metrics"
-	"github.com/eugeniylennik/alertics/internal/server"
 	"github.com/eugeniylennik/alertics/internal/storage"
-	"github.com/eugeniylennik/alertics/internal/storage/database"
+	"github.com/eugeniylennik/alertics/internal/telemetry"
 	"github.com/go-chi/chi/v5"
-	"github.com/jackc/pgx/v5/pgxpool"
-	"io"
 	"net/http"
 	"strconv"
 )
 
-var cfg = server.InitConfigServer()
-
-type Repository interface {
-	AddGauge(m metrics.Data) error
-	AddCounter(m metrics.Data) error
-	GetGauge(name string) (float64, error)
-	GetCounter(name string) (int64, error)
-	GetAllMetrics() ([]byte, error)
-}
-
-func RecordMetrics(repo Repository) http.HandlerFunc {
+// RecordMetrics stores a metric given in the URL. URLs cannot carry a
+// signature, so the route is refused when a signer is configured.
+func RecordMetrics(repo storage.Repository, signer *Signer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if signer != nil {
+			http.Error(w, errUnsignedUpdate.Error(), http.StatusForbidden)
+			return
+		}
+
 		typeMetric := chi.URLParam(r, "type")
 		name := chi.URLParam(r, "name")
 		value := chi.URLParam(r, "value")
 
-		if typeMetric != storage.Gauge && typeMetric != storage.Counter {
-			w.WriteHeader(http.StatusNotImplemented)
-			return
-		}
-		v, err := strconv.ParseFloat(value, 64)
+		labels, err := labelsFromQuery(r)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		m := metrics.Data{
-			Type:  typeMetric,
-			Name:  name,
-			Value: v,
+
+		m := metrics.Metrics{
+			ID:     name,
+			MType:  typeMetric,
+			Labels: labels,
 		}
 		switch typeMetric {
 		case storage.Gauge:
-			_ = repo.AddGauge(m)
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			m.Value = &v
 		case storage.Counter:
-			_ = repo.AddCounter(m)
+			v, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			m.Delta = &v
+		case storage.Histogram:
+			v, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if m.Histogram, err = observation(r, repo, m, v); err != nil {
+				http.Error(w, err.Error(), statusFromError(err))
+				return
+			}
+		default:
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+
+		if _, err := repo.UpsertMetric(r.Context(), m); err != nil {
+			http.Error(w, err.Error(), statusFromError(err))
+			return
 		}
 
 		w.Header().Set("Content-Type", "text/plain")
@@ -57,194 +75,202 @@ func RecordMetrics(repo Repository) http.HandlerFunc {
 	}
 }
 
-func RecordMetricsByJSON(repo Repository, db database.Repository) http.HandlerFunc {
+// RecordMetricsByJSON stores a single metric. With a signer the metric must
+// be signed and the response is signed with the same signature version.
+func RecordMetricsByJSON(repo storage.Repository, signer *Signer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		version, err := signer.version(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
 		var m metrics.Metrics
-		var d metrics.Data
 
 		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		if m.Hash == "" {
-			http.Error(w, fmt.Sprintf("hash empty"), http.StatusBadRequest)
+		if err := storage.Validate(m); err != nil {
+			http.Error(w, err.Error(), statusFromError(err))
 			return
 		}
 
-		_, err := m.IsHashesEquals()
-		//if !ok {
-		//	http.Error(w, fmt.Sprintf("hashes is not equals"), http.StatusBadRequest)
-		//	return
-		//}
+		if err := signer.Verify(version, m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 
-		d = metrics.Data{
-			Name: m.ID,
-			Type: m.MType,
+		result, err := repo.UpsertMetric(r.Context(), m)
+		if err != nil {
+			signer.Release(version, m)
+			http.Error(w, err.Error(), statusFromError(err))
+			return
 		}
 
-		if m.MType == storage.Gauge {
-			d.Value = *m.Value
-		} else {
-			d.Value = float64(*m.Delta)
+		w.Header().Set(metrics.SignatureVersionHeader, strconv.Itoa(version))
+		writeJSON(w, signer.Sign(version, result))
+	}
+}
+
+// RecordMetricsBatch stores a batch of metrics; with a signer every metric
+// must be signed and nothing is stored if any signature does not match.
+func RecordMetricsBatch(repo storage.Repository, signer *Signer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		version, err := signer.version(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
 		}
 
-		if cfg.Dsn == "" {
-			switch d.Type {
-			case storage.Gauge:
-				_ = repo.AddGauge(d)
-				*m.Value, _ = repo.GetGauge(d.Name)
-			case storage.Counter:
-				_ = repo.AddCounter(d)
-				*m.Delta, _ = repo.GetCounter(d.Name)
+		var m []metrics.Metrics
+
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		telemetry.BatchSize.Observe(float64(len(m)))
+
+		for i, v := range m {
+			if err := storage.Validate(v); err != nil {
+				signer.Release(version, m[:i]...)
+				http.Error(w, err.Error(), statusFromError(err))
+				return
 			}
-		} else {
-			err = db.InsertMetrics(context.Background(), m)
-			if err != nil {
+			if err := signer.Verify(version, v); err != nil {
+				signer.Release(version, m[:i]...)
 				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 		}
 
-		result, err := json.MarshalIndent(m, "", " ")
+		result, err := repo.UpsertMetrics(r.Context(), m)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			signer.Release(version, m...)
+			http.Error(w, err.Error(), statusFromError(err))
+			return
 		}
 
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write(result)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		for i := range result {
+			result[i] = signer.Sign(version, result[i])
 		}
+		w.Header().Set(metrics.SignatureVersionHeader, strconv.Itoa(version))
+		writeJSON(w, result)
 	}
 }
 
-func GetSpecificMetricJSON(repo Repository, db database.Repository) http.HandlerFunc {
+func GetSpecificMetricJSON(repo storage.Repository, signer *Signer) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		b, err := io.ReadAll(r.Body)
+		version, err := signer.version(r)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
 		var m metrics.Metrics
-		if err := json.Unmarshal(b, &m); err != nil {
+		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		if cfg.Dsn == "" {
-			switch m.MType {
-			case storage.Gauge:
-				v, err := repo.GetGauge(m.ID)
-				if err != nil {
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
-				r := metrics.Metrics{
-					ID:    m.ID,
-					MType: m.MType,
-					Value: &v,
-				}
-				b, err := json.Marshal(r)
-				if err != nil {
-					w.WriteHeader(http.StatusBadRequest)
-					return
-				}
-				w.WriteHeader(http.StatusOK)
-				w.Write(b)
-			case storage.Counter:
-				v, err := repo.GetCounter(m.ID)
-				if err != nil {
-					w.WriteHeader(http.StatusNotFound)
-					return
-				}
-				r := metrics.Metrics{
-					ID:    m.ID,
-					MType: m.MType,
-					Delta: &v,
-				}
-				b, err := json.Marshal(r)
-				if err != nil {
-					w.WriteHeader(http.StatusBadRequest)
-					return
-				}
-				w.WriteHeader(http.StatusOK)
-				w.Write(b)
-			default:
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-		} else {
-			r, err := db.SelectMetricById(context.Background(), m)
-			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			b, err := json.Marshal(r)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
-			w.Write(b)
+		result, err := storage.FindMetric(r.Context(), repo, m.MType, m.ID, m.Labels)
+		if err != nil {
+			http.Error(w, err.Error(), lookupStatusFromError(err))
+			return
+		}
+
+		w.Header().Set(metrics.SignatureVersionHeader, strconv.Itoa(version))
+		writeJSON(w, signer.Sign(version, result))
+	}
+}
+
+// observation returns a histogram holding the single observation v. It uses
+// the buckets of the stored series, the buckets query parameter for a new
+// series, e.g. ?buckets=0.1,0.5,1, or the default buckets.
+func observation(r *http.Request, repo storage.Repository, m metrics.Metrics, v float64) (*metrics.Histogram, error) {
+	buckets := metrics.DefaultBuckets
+	stored, err := repo.GetMetric(r.Context(), m.MType, m.ID, m.Labels)
+	switch {
+	case err == nil:
+		buckets = stored.Histogram.Buckets
+	case !errors.Is(err, storage.ErrNotFound):
+		return nil, err
+	case r.URL.Query().Has("buckets"):
+		if buckets, err = metrics.ParseBuckets(r.URL.Query().Get("buckets")); err != nil {
+			return nil, err
 		}
 	}
+	h := metrics.NewHistogram(buckets)
+	h.Observe(v)
+	return h, nil
 }
 
-func GetSpecificMetric(repo Repository) http.HandlerFunc {
+// GetSpecificMetric writes the value of a metric. Histograms are written as
+// JSON, or as the estimate of the quantile in the quantile query parameter,
+// e.g. ?quantile=0.99.
+func GetSpecificMetric(repo storage.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		typeMetric := chi.URLParam(r, "type")
 		name := chi.URLParam(r, "name")
 
-		switch typeMetric {
+		matchers, err := labelsFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		m, err := storage.FindMetric(r.Context(), repo, typeMetric, name, matchers)
+		if err != nil {
+			http.Error(w, err.Error(), lookupStatusFromError(err))
+			return
+		}
+
+		var b []byte
+		switch m.MType {
 		case storage.Gauge:
-			v, err := repo.GetGauge(name)
-			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			b, err := json.Marshal(v)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
-			w.Write(b)
+			b, err = json.Marshal(*m.Value)
 		case storage.Counter:
-			v, err := repo.GetCounter(name)
-			if err != nil {
-				w.WriteHeader(http.StatusNotFound)
-				return
-			}
-			b, err := json.Marshal(v)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				return
-			}
-			w.WriteHeader(http.StatusOK)
-			w.Write(b)
-		default:
-			w.WriteHeader(http.StatusNotFound)
+			b, err = json.Marshal(*m.Delta)
+		case storage.Histogram:
+			b, err = marshalHistogram(r, m.Histogram)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), statusFromError(err))
 			return
 		}
+		w.WriteHeader(http.StatusOK)
+		w.Write(b)
 	}
 }
 
-func GetMetrics(repo Repository) http.HandlerFunc {
+func GetMetrics(repo storage.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		m, err := repo.GetAllMetrics()
+		matchers, err := labelsFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m, err := repo.ListMetrics(r.Context())
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		b, err := storage.MarshalMetrics(storage.FilterMetrics(m, matchers))
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
 		}
 		w.Header().Set("Content-Type", "text/html")
 		w.WriteHeader(http.StatusOK)
-		w.Write(m)
+		w.Write(b)
 	}
 }
 
-func HealthCheckDB(pgx *pgxpool.Pool) http.HandlerFunc {
+func HealthCheck(repo storage.Repository) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		err := pgx.Ping(context.TODO())
+		err := repo.Ping(r.Context())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -253,26 +279,59 @@ func HealthCheckDB(pgx *pgxpool.Pool) http.HandlerFunc {
 	}
 }
 
-func RecordMetricsBatch(db database.Repository) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		var m []metrics.Metrics
+func marshalHistogram(r *http.Request, h *metrics.Histogram) ([]byte, error) {
+	if !r.URL.Query().Has("quantile") {
+		return json.Marshal(h)
+	}
+	q, err := strconv.ParseFloat(r.URL.Query().Get("quantile"), 64)
+	if err != nil {
+		return nil, metrics.ErrInvalidQuantile
+	}
+	v, err := h.Quantile(q)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
 
-		if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
+// labelsFromQuery parses the labels query parameter, e.g.
+// ?labels=host=web-1,env=prod. Lookups use them as label matchers.
+func labelsFromQuery(r *http.Request) (metrics.Labels, error) {
+	return metrics.ParseLabelList(r.URL.Query().Get("labels"))
+}
 
-		if err := db.InsertMetricsStatement(context.Background(), m); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
-		result, err := json.MarshalIndent(m, "", " ")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(b)
+}
 
-		w.WriteHeader(http.StatusOK)
-		_, err = w.Write(result)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-		}
+func statusFromError(err error) int {
+	switch {
+	case errors.Is(err, storage.ErrNotFound), errors.Is(err, storage.ErrSilenceNotFound),
+		errors.Is(err, metrics.ErrEmptyHistogram):
+		return http.StatusNotFound
+	case errors.Is(err, storage.ErrInvalidType):
+		return http.StatusNotImplemented
+	case errors.Is(err, storage.ErrEmptyValue), errors.Is(err, storage.ErrInvalidID),
+		errors.Is(err, metrics.ErrInvalidLabels), errors.Is(err, metrics.ErrInvalidHistogram),
+		errors.Is(err, metrics.ErrInvalidQuantile):
+		return http.StatusBadRequest
+	case errors.Is(err, storage.ErrAmbiguousSeries), errors.Is(err, metrics.ErrBucketsMismatch):
+		return http.StatusConflict
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// lookupStatusFromError reports unknown metric types as missing metrics.
+func lookupStatusFromError(err error) int {
+	if errors.Is(err, storage.ErrInvalidType) {
+		return http.StatusNotFound
 	}
+	return statusFromError(err)
 }
@@ -1,38 +1,368 @@
 package handlers_test
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
-	"github.com/eugeniylennik/alertics/internal/database"
+	"encoding/json"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/metrics"
 	"github.com/eugeniylennik/alertics/internal/router"
-	"github.com/eugeniylennik/alertics/internal/server"
 	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/eugeniylennik/alertics/internal/telemetry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"io"
-	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestHandler_RecordMetrics(t *testing.T) {
-	cfg := server.InitConfigServer()
-	m := storage.NewMemStorage(cfg.StoreFile, cfg.StoreInterval == 0)
-	client, err := database.NewClient(context.TODO(), 5, cfg.Dsn)
-	if err != nil {
-		log.Fatalln(err)
-	}
-	r := router.NewRouter(m, client)
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(m)
 	ts := httptest.NewServer(r)
 	defer ts.Close()
 
-	statusCode, body := testRequest(t, ts, "POST", "/update/gauge/Alloc/12.12")
+	statusCode, body := testRequest(t, ts, "POST", "/update/gauge/Alloc/12.12", "")
 	assert.Equal(t, http.StatusOK, statusCode)
 	assert.Equal(t, body, "")
 }
 
-func testRequest(t *testing.T, ts *httptest.Server, method, path string) (int, string) {
-	req, err := http.NewRequest(method, ts.URL+path, nil)
+func TestHandler_RecordMetricsBatch(t *testing.T) {
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(m)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/updates",
+		`[{"id":"PollCount","type":"counter","delta":2},{"id":"PollCount","type":"counter","delta":3},{"id":"Alloc","type":"gauge","value":1.5}]`)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body := testRequest(t, ts, "GET", "/value/counter/PollCount", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "5", body)
+
+	statusCode, body = testRequest(t, ts, "POST", "/value", `{"id":"Alloc","type":"gauge"}`)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","value":1.5}`, body)
+
+	statusCode, _ = testRequest(t, ts, "GET", "/value/gauge/Unknown", "")
+	assert.Equal(t, http.StatusNotFound, statusCode)
+}
+
+func TestHandler_Labels(t *testing.T) {
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(m)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/updates",
+		`[{"id":"Alloc","type":"gauge","labels":{"host":"web-1","env":"prod"},"value":1},{"id":"Alloc","type":"gauge","labels":{"host":"web-2","env":"prod"},"value":2}]`)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body := testRequest(t, ts, "GET", "/value/gauge/Alloc?labels=host=web-2", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "2", body)
+
+	statusCode, body = testRequest(t, ts, "POST", "/value", `{"id":"Alloc","type":"gauge","labels":{"host":"web-1"}}`)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","labels":{"host":"web-1","env":"prod"},"value":1}`, body)
+
+	statusCode, _ = testRequest(t, ts, "GET", "/value/gauge/Alloc?labels=env=prod", "")
+	assert.Equal(t, http.StatusConflict, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "GET", "/value/gauge/Alloc?labels=host=web-3", "")
+	assert.Equal(t, http.StatusNotFound, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update/gauge/Alloc/3?labels=host=web-3", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body = testRequest(t, ts, "GET", "/?labels=host=web-3", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, `Alloc{host=\"web-3\"}`)
+	assert.NotContains(t, body, "web-1")
+
+	// Braces would be taken for labels when the file storage is restored.
+	statusCode, _ = testRequest(t, ts, "POST", "/update", `{"id":"Alloc{host=\"web-4\"}","type":"gauge","value":4}`)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestHandler_Histogram(t *testing.T) {
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(m)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/updates",
+		`[{"id":"Latency","type":"histogram","histogram":{"buckets":[1,2,4],"counts":[1,3,4],"count":5,"sum":16.5}}]`)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body := testRequest(t, ts, "POST", "/update",
+		`{"id":"Latency","type":"histogram","histogram":{"buckets":[1,2,4],"counts":[1,1,1],"count":1,"sum":0.5}}`)
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"id":"Latency","type":"histogram","histogram":{"buckets":[1,2,4],"counts":[2,4,5],"count":6,"sum":17}}`, body)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update/histogram/Latency/1.5", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body = testRequest(t, ts, "GET", "/value/histogram/Latency", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.JSONEq(t, `{"buckets":[1,2,4],"counts":[2,5,6],"count":7,"sum":18.5}`, body)
+
+	statusCode, body = testRequest(t, ts, "GET", "/value/histogram/Latency?quantile=0.5", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "1.5", body)
+
+	statusCode, _ = testRequest(t, ts, "GET", "/value/histogram/Latency?quantile=2", "")
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update",
+		`{"id":"Latency","type":"histogram","histogram":{"buckets":[1,5],"counts":[1,1],"count":1,"sum":0.5}}`)
+	assert.Equal(t, http.StatusConflict, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update",
+		`{"id":"Invalid","type":"histogram","histogram":{"buckets":[2,1],"counts":[0,0],"count":0,"sum":0}}`)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "POST", "/update/histogram/Small/0.05?buckets=0.1,1", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body = testRequest(t, ts, "GET", "/metrics", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, "# TYPE Latency histogram\n")
+	assert.Contains(t, body, `Latency_bucket{le="+Inf"} 7`)
+	assert.Contains(t, body, `Small_bucket{le="0.1"} 1`)
+}
+
+func TestHandler_RecordMetricsBatchGzip(t *testing.T) {
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(m, router.WithMaxDecompressedSize(1024))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	post := func(body string) int {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		_, err := gz.Write([]byte(body))
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+
+		req, err := http.NewRequest("POST", ts.URL+"/updates", &buf)
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", "gzip")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	assert.Equal(t, http.StatusOK, post(`[{"id":"PollCount","type":"counter","delta":2}]`))
+	statusCode, body := testRequest(t, ts, "GET", "/value/counter/PollCount", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Equal(t, "2", body)
+
+	bomb := `[{"id":"PollCount","type":"counter","delta":2}` + strings.Repeat(" ", 4096) + `]`
+	assert.Equal(t, http.StatusRequestEntityTooLarge, post(bomb))
+}
+
+func TestHandler_Signing(t *testing.T) {
+	const key = "secret"
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(m, router.WithKey(key))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	delta := int64(3)
+	signed := metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &delta}
+	signed.Hash = signed.ComputeHash(key, metrics.SignatureLegacy)
+	b, err := json.Marshal(signed)
+	require.NoError(t, err)
+
+	statusCode, _ := signedRequest(t, ts, key, nil, "POST", "/update", string(b))
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, _ = signedRequest(t, ts, key, nil, "POST", "/update", `{"id":"PollCount","type":"counter","delta":3}`)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	// Updates in the URL cannot be signed.
+	statusCode, _ = testRequest(t, ts, "POST", "/update/counter/PollCount/3", "")
+	assert.Equal(t, http.StatusForbidden, statusCode)
+
+	// The body signature is required and must match.
+	statusCode, _ = testRequest(t, ts, "POST", "/update", string(b))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	forged := signed
+	forged.Hash = signed.ComputeHash("other", metrics.SignatureLegacy)
+	b, err = json.Marshal([]metrics.Metrics{signed, forged})
+	require.NoError(t, err)
+	statusCode, _ = signedRequest(t, ts, key, nil, "POST", "/updates", string(b))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	// Only metric updates need a body signature.
+	statusCode, body := testRequest(t, ts, "POST", "/value", `{"id":"PollCount","type":"counter"}`)
+	assert.Equal(t, http.StatusOK, statusCode)
+	var result metrics.Metrics
+	require.NoError(t, json.Unmarshal([]byte(body), &result))
+	assert.Equal(t, int64(3), *result.Delta)
+	assert.True(t, result.VerifyHash(key, metrics.SignatureLegacy))
+
+	statusCode, _ = testRequest(t, ts, "POST", "/api/v1/silences", `{"author":"oncall","ends_at":"2030-01-01T00:00:00Z","matchers":{"metric":"PollCount"}}`)
+	assert.Equal(t, http.StatusCreated, statusCode)
+
+	// Legacy signatures cover neither labels nor histograms.
+	labeled := metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &delta, Labels: metrics.Labels{"host": "web-1"}}
+	labeled.Hash = labeled.ComputeHash(key, metrics.SignatureLegacy)
+	b, err = json.Marshal(labeled)
+	require.NoError(t, err)
+	statusCode, _ = signedRequest(t, ts, key, nil, "POST", "/update", string(b))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	strict := httptest.NewServer(router.NewRouter(m, router.WithKey(key), router.WithRequireCanonicalSignatures(true)))
+	defer strict.Close()
+	b, err = json.Marshal(signed)
+	require.NoError(t, err)
+	statusCode, _ = signedRequest(t, strict, key, nil, "POST", "/update", string(b))
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+}
+
+func TestHandler_CanonicalSigning(t *testing.T) {
+	const key = "secret"
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(m, router.WithKey(key))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	post := func(path string, v interface{}) (int, string) {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		return signedRequest(t, ts, key, map[string]string{metrics.SignatureVersionHeader: "2"}, "POST", path, string(b))
+	}
+	sign := func(m metrics.Metrics, ts time.Time) metrics.Metrics {
+		m.Timestamp = ts.Unix()
+		m.Nonce = metrics.NewNonce()
+		m.Hash = m.ComputeHash(key, metrics.SignatureCanonical)
+		return m
+	}
+
+	value := 0.25
+	gauge := sign(metrics.Metrics{ID: "GCCPUFraction", MType: "gauge", Value: &value}, time.Now())
+	statusCode, _ := post("/update", gauge)
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	// The same signed metric cannot be replayed.
+	statusCode, _ = post("/update", gauge)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	// The legacy format ignores fractions, the canonical one does not.
+	tampered := gauge
+	tampered.Nonce = metrics.NewNonce()
+	tampered.Hash = sign(tampered, time.Now()).Hash
+	other := 0.75
+	tampered.Value = &other
+	statusCode, _ = post("/update", tampered)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	stale := sign(metrics.Metrics{ID: "GCCPUFraction", MType: "gauge", Value: &value}, time.Now().Add(-time.Hour))
+	statusCode, _ = post("/update", stale)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	req, err := http.NewRequest("POST", ts.URL+"/value", strings.NewReader(`{"id":"GCCPUFraction","type":"gauge"}`))
+	require.NoError(t, err)
+	req.Header.Set(metrics.SignatureVersionHeader, "2")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var result metrics.Metrics
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	assert.Equal(t, 0.25, *result.Value)
+	assert.NotEmpty(t, result.Nonce)
+	assert.True(t, result.VerifyHash(key, metrics.SignatureCanonical))
+}
+
+// flakyRepository fails the next upserts while failures is positive.
+type flakyRepository struct {
+	storage.Repository
+	failures int
+}
+
+func (r *flakyRepository) UpsertMetric(ctx context.Context, m metrics.Metrics) (metrics.Metrics, error) {
+	if r.failures > 0 {
+		r.failures--
+		return metrics.Metrics{}, errors.New("database is unavailable")
+	}
+	return r.Repository.UpsertMetric(ctx, m)
+}
+
+func (r *flakyRepository) Unwrap() storage.Repository {
+	return r.Repository
+}
+
+func TestHandler_CanonicalSigningRetry(t *testing.T) {
+	const key = "secret"
+	repo := &flakyRepository{Repository: storage.NewMemStorage(storage.DefaultHistorySize), failures: 1}
+	r := router.NewRouter(repo, router.WithKey(key))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	post := func(path string, v interface{}) int {
+		b, err := json.Marshal(v)
+		require.NoError(t, err)
+		statusCode, _ := signedRequest(t, ts, key, map[string]string{metrics.SignatureVersionHeader: "2"}, "POST", path, string(b))
+		return statusCode
+	}
+	sign := func(m metrics.Metrics) metrics.Metrics {
+		m.Timestamp = time.Now().Unix()
+		m.Nonce = metrics.NewNonce()
+		m.Hash = m.ComputeHash(key, metrics.SignatureCanonical)
+		return m
+	}
+
+	// A retry of a metric that failed to be stored is not a replay.
+	value := 0.25
+	gauge := sign(metrics.Metrics{ID: "GCCPUFraction", MType: "gauge", Value: &value})
+	assert.Equal(t, http.StatusInternalServerError, post("/update", gauge))
+	assert.Equal(t, http.StatusOK, post("/update", gauge))
+	assert.Equal(t, http.StatusBadRequest, post("/update", gauge))
+
+	// A rejected batch does not use up the nonces of its valid metrics.
+	delta := int64(1)
+	counter := sign(metrics.Metrics{ID: "PollCount", MType: "counter", Delta: &delta})
+	invalid := sign(metrics.Metrics{ID: "PollCount", MType: "counter"})
+	assert.Equal(t, http.StatusBadRequest, post("/updates", []metrics.Metrics{counter, invalid}))
+	assert.Equal(t, http.StatusOK, post("/update", counter))
+}
+
+// signedRequest signs body with key and checks the signature of the
+// response.
+func signedRequest(t *testing.T, ts *httptest.Server, key string, header map[string]string, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set(metrics.BodyHashHeader, metrics.BodyHash(key, []byte(body)))
+	// The signature covers the response as sent, so keep the transport from
+	// decompressing it.
+	req.Header.Set("Accept-Encoding", "identity")
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, metrics.BodyHash(key, respBody), resp.Header.Get(metrics.BodyHashHeader))
+	return resp.StatusCode, string(respBody)
+}
+
+func testRequest(t *testing.T, ts *httptest.Server, method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
 	require.NoError(t, err)
 
 	resp, err := http.DefaultClient.Do(req)
@@ -45,3 +375,86 @@ func testRequest(t *testing.T, ts *httptest.Server, method, path string) (int, s
 
 	return resp.StatusCode, string(respBody)
 }
+
+func TestHandler_Silences(t *testing.T) {
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(m)
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/api/v1/silences", `{"author":"oncall","ends_at":"2030-01-01T00:00:00Z"}`)
+	assert.Equal(t, http.StatusBadRequest, statusCode)
+
+	statusCode, body := testRequest(t, ts, "POST", "/api/v1/silences",
+		`{"matchers":{"metric":"HeapAlloc"},"author":"oncall","comment":"maintenance","ends_at":"2030-01-01T00:00:00Z"}`)
+	require.Equal(t, http.StatusCreated, statusCode)
+
+	var s struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	require.NoError(t, json.Unmarshal([]byte(body), &s))
+	assert.Equal(t, "active", s.Status)
+
+	statusCode, body = testRequest(t, ts, "GET", "/api/v1/silences", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, s.ID)
+
+	statusCode, _ = testRequest(t, ts, "DELETE", "/api/v1/silences/"+s.ID, "")
+	assert.Equal(t, http.StatusNoContent, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "GET", "/api/v1/silences/"+s.ID, "")
+	assert.Equal(t, http.StatusNotFound, statusCode)
+}
+
+func TestHandler_SilencesTrustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	ts := httptest.NewServer(router.NewRouter(m, router.WithTrustedSubnet(subnet)))
+	defer ts.Close()
+
+	create := `{"matchers":{"metric":"HeapAlloc"},"author":"oncall","ends_at":"2030-01-01T00:00:00Z"}`
+	statusCode, _ := testRequest(t, ts, "POST", "/api/v1/silences", create)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+
+	req, err := http.NewRequest("POST", ts.URL+"/api/v1/silences", strings.NewReader(create))
+	require.NoError(t, err)
+	req.Header.Set("X-Real-IP", "10.0.0.1")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var s struct {
+		ID string `json:"id"`
+	}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	// Silences can still be read from anywhere.
+	statusCode, _ = testRequest(t, ts, "GET", "/api/v1/silences/"+s.ID, "")
+	assert.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, _ = testRequest(t, ts, "PUT", "/api/v1/silences/"+s.ID, create)
+	assert.Equal(t, http.StatusForbidden, statusCode)
+	statusCode, _ = testRequest(t, ts, "DELETE", "/api/v1/silences/"+s.ID, "")
+	assert.Equal(t, http.StatusForbidden, statusCode)
+}
+
+func TestHandler_PrometheusMetrics(t *testing.T) {
+	m := storage.NewMemStorage(storage.DefaultHistorySize)
+	r := router.NewRouter(telemetry.InstrumentRepository(m))
+	ts := httptest.NewServer(r)
+	defer ts.Close()
+
+	statusCode, _ := testRequest(t, ts, "POST", "/update/counter/PollCount/3", "")
+	require.Equal(t, http.StatusOK, statusCode)
+	statusCode, _ = testRequest(t, ts, "POST", "/update/gauge/alertics_fake/1", "")
+	require.Equal(t, http.StatusOK, statusCode)
+
+	statusCode, body := testRequest(t, ts, "GET", "/metrics", "")
+	assert.Equal(t, http.StatusOK, statusCode)
+	assert.Contains(t, body, "# TYPE PollCount counter\nPollCount 3\n")
+	assert.NotContains(t, body, "alertics_fake")
+	assert.Contains(t, body, `alertics_http_requests_total{method="POST",route="/update/{type}/{name}/{value}",status="200"}`)
+	assert.Contains(t, body, `alertics_storage_operation_duration_seconds_count{operation="upsert"}`)
+}
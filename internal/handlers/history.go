@@ -0,0 +1,167 @@
+package handlers
+
+import (
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultQueryRange = time.Hour
+
+type rangeResponse struct {
+	ID      string           `json:"id"`
+	MType   string           `json:"type"`
+	Labels  metrics.Labels   `json:"labels,omitempty"`
+	Samples []storage.Sample `json:"samples"`
+}
+
+type rollupResponse struct {
+	ID         string         `json:"id"`
+	MType      string         `json:"type"`
+	Labels     metrics.Labels `json:"labels,omitempty"`
+	Resolution string         `json:"resolution"`
+	Rollups    []rollupPoint  `json:"rollups"`
+}
+
+// rollupPoint exposes min/max/avg/last for gauges and sum/rate for counters
+// and for the number of observations of histograms.
+type rollupPoint struct {
+	Timestamp time.Time `json:"timestamp"`
+	Count     int64     `json:"count"`
+	Min       *float64  `json:"min,omitempty"`
+	Max       *float64  `json:"max,omitempty"`
+	Avg       *float64  `json:"avg,omitempty"`
+	Last      *float64  `json:"last,omitempty"`
+	Sum       *float64  `json:"sum,omitempty"`
+	Rate      *float64  `json:"rate,omitempty"`
+}
+
+func newRollupPoint(mType string, r storage.Rollup, resolution time.Duration) rollupPoint {
+	p := rollupPoint{Timestamp: r.Timestamp, Count: r.Count}
+	if mType == storage.Counter || mType == storage.Histogram {
+		rate := r.Rate(resolution)
+		p.Sum, p.Rate = &r.Sum, &rate
+		return p
+	}
+	avg := r.Avg()
+	p.Min, p.Max, p.Avg, p.Last = &r.Min, &r.Max, &avg, &r.Last
+	return p
+}
+
+// QueryRange serves GET /api/v1/query_range?id=...&type=...&from=...&to=...&step=...
+// labels=name=value,... selects the series like on /value.
+// from and to accept RFC 3339 or unix seconds and default to the last hour;
+// step is a Go duration and keeps the last sample of every step-wide bucket.
+// With resolution=1m (or any configured rollup resolution) the stored rollups
+// are returned instead of raw samples.
+func QueryRange(repo storage.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		id := q.Get("id")
+		typeMetric := q.Get("type")
+		if id == "" || typeMetric == "" {
+			http.Error(w, "id and type are required", http.StatusBadRequest)
+			return
+		}
+		matchers, err := metrics.ParseLabelList(q.Get("labels"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		to := time.Now()
+		if v := q.Get("to"); v != "" {
+			t, err := parseTime(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			to = t
+		}
+		from := to.Add(-defaultQueryRange)
+		if v := q.Get("from"); v != "" {
+			t, err := parseTime(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			from = t
+		}
+		if from.After(to) {
+			http.Error(w, "from must not be after to", http.StatusBadRequest)
+			return
+		}
+
+		var step time.Duration
+		if v := q.Get("step"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				http.Error(w, fmt.Sprintf("invalid step %q", v), http.StatusBadRequest)
+				return
+			}
+			step = d
+		}
+
+		if v := q.Get("resolution"); v != "" {
+			resolution, err := time.ParseDuration(v)
+			if err != nil || resolution <= 0 {
+				http.Error(w, fmt.Sprintf("invalid resolution %q", v), http.StatusBadRequest)
+				return
+			}
+			rs, ok := storage.As[storage.RollupStore](repo)
+			if !ok {
+				http.Error(w, "rollups are not supported by the storage", http.StatusNotImplemented)
+				return
+			}
+			m, err := storage.FindMetric(r.Context(), repo, typeMetric, id, matchers)
+			if err != nil {
+				http.Error(w, err.Error(), lookupStatusFromError(err))
+				return
+			}
+			rollups, err := rs.QueryRollups(r.Context(), typeMetric, id, m.Labels, resolution, from, to)
+			if err != nil {
+				http.Error(w, err.Error(), lookupStatusFromError(err))
+				return
+			}
+			points := make([]rollupPoint, 0, len(rollups))
+			for _, v := range rollups {
+				points = append(points, newRollupPoint(typeMetric, v, resolution))
+			}
+			writeJSON(w, rollupResponse{ID: id, MType: typeMetric, Labels: m.Labels, Resolution: resolution.String(), Rollups: points})
+			return
+		}
+
+		m, err := storage.FindMetric(r.Context(), repo, typeMetric, id, matchers)
+		if err != nil {
+			http.Error(w, err.Error(), lookupStatusFromError(err))
+			return
+		}
+		samples, err := repo.QueryRange(r.Context(), typeMetric, id, m.Labels, from, to)
+		if err != nil {
+			http.Error(w, err.Error(), lookupStatusFromError(err))
+			return
+		}
+
+		samples = storage.Downsample(samples, from, step)
+		if samples == nil {
+			samples = []storage.Sample{}
+		}
+		writeJSON(w, rangeResponse{ID: id, MType: typeMetric, Labels: m.Labels, Samples: samples})
+	}
+}
+
+func parseTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q", v)
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(frac*float64(time.Second))), nil
+}
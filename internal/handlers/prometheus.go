@@ -0,0 +1,43 @@
+package handlers
+
+import (
+	"github.com/eugeniylennik/alertics/internal/prometheus"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/eugeniylennik/alertics/internal/telemetry"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// GetPrometheusMetrics serves GET /metrics in the Prometheus text format,
+// followed by the server self-metrics. The alertics_ prefix is reserved for
+// the latter, so stored metrics using it are not exposed. The labels query
+// parameter filters the stored metrics.
+func GetPrometheusMetrics(repo storage.Repository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		matchers, err := labelsFromQuery(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		m, err := repo.ListMetrics(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		var families []prometheus.Family
+		for _, f := range prometheus.FromMetrics(storage.FilterMetrics(m, matchers)) {
+			if !strings.HasPrefix(f.Name, telemetry.Prefix) {
+				families = append(families, f)
+			}
+		}
+		families = append(families, telemetry.Default.Gather()...)
+
+		w.Header().Set("Content-Type", prometheus.ContentType)
+		w.WriteHeader(http.StatusOK)
+		if err := prometheus.Write(w, families); err != nil {
+			log.Printf("failed to write metrics: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/telemetry"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DefaultSignatureMaxSkew is how far the timestamp of a canonical signature
+// may be from the server clock.
+const DefaultSignatureMaxSkew = 5 * time.Minute
+
+var (
+	errHashMismatch            = errors.New("hash mismatch")
+	errStaleSignature          = errors.New("signature timestamp is out of range")
+	errReplayedSignature       = errors.New("signature nonce was already used")
+	errUnknownSignatureVersion = errors.New("unknown signature version")
+	errLegacySignature         = errors.New("legacy signatures are not accepted for this metric")
+	errUnsignedUpdate          = errors.New("metrics must be sent signed as JSON")
+)
+
+// Signer verifies the signatures of received metrics and signs the returned
+// ones. Canonical signatures are accepted once within their validity window
+// of maxSkew around the server clock. Legacy signatures cover neither labels
+// nor histograms, so they are only accepted for plain gauges and counters,
+// and not at all when canonical signatures are required. A nil Signer
+// disables signing.
+type Signer struct {
+	key              string
+	maxSkew          time.Duration
+	requireCanonical bool
+	now              func() time.Time
+
+	mux       sync.Mutex
+	nonces    map[string]time.Time
+	lastSweep time.Time
+}
+
+func NewSigner(key string, maxSkew time.Duration, requireCanonical bool) *Signer {
+	if maxSkew <= 0 {
+		maxSkew = DefaultSignatureMaxSkew
+	}
+	return &Signer{
+		key:              key,
+		maxSkew:          maxSkew,
+		requireCanonical: requireCanonical,
+		now:              time.Now,
+		nonces:           map[string]time.Time{},
+	}
+}
+
+// version returns the signature version requested by r.
+func (s *Signer) version(r *http.Request) (int, error) {
+	return ParseSignatureVersion(r.Header.Get(metrics.SignatureVersionHeader))
+}
+
+// ParseSignatureVersion parses the value of a signature version header; an
+// empty value selects legacy signatures.
+func ParseSignatureVersion(v string) (int, error) {
+	if v == "" {
+		return metrics.SignatureLegacy, nil
+	}
+	version, err := strconv.Atoi(v)
+	if err != nil || (version != metrics.SignatureLegacy && version != metrics.SignatureCanonical) {
+		return 0, errUnknownSignatureVersion
+	}
+	return version, nil
+}
+
+// Verify checks the signature of a received metric and reserves its nonce.
+// Callers must Release the nonces of metrics that end up not being stored so
+// that the client can retry the same signed request.
+func (s *Signer) Verify(version int, m metrics.Metrics) error {
+	if s == nil {
+		return nil
+	}
+	if version != metrics.SignatureCanonical &&
+		(s.requireCanonical || len(m.Labels) > 0 || m.Histogram != nil) {
+		telemetry.HashVerificationFailures.Inc()
+		return errLegacySignature
+	}
+	if !m.VerifyHash(s.key, version) {
+		telemetry.HashVerificationFailures.Inc()
+		return errHashMismatch
+	}
+	if version != metrics.SignatureCanonical {
+		return nil
+	}
+
+	now := s.now()
+	ts := time.Unix(m.Timestamp, 0)
+	if ts.Before(now.Add(-s.maxSkew)) || ts.After(now.Add(s.maxSkew)) {
+		telemetry.HashVerificationFailures.Inc()
+		return errStaleSignature
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	// Nonces only need to be remembered while their timestamp is valid.
+	if now.Sub(s.lastSweep) >= s.maxSkew {
+		for nonce, expires := range s.nonces {
+			if expires.Before(now) {
+				delete(s.nonces, nonce)
+			}
+		}
+		s.lastSweep = now
+	}
+	if m.Nonce == "" {
+		telemetry.HashVerificationFailures.Inc()
+		return errHashMismatch
+	}
+	if _, ok := s.nonces[m.Nonce]; ok {
+		telemetry.HashVerificationFailures.Inc()
+		return errReplayedSignature
+	}
+	s.nonces[m.Nonce] = ts.Add(s.maxSkew)
+	return nil
+}
+
+// Release forgets the nonces reserved by Verify for metrics that were not
+// stored.
+func (s *Signer) Release(version int, ms ...metrics.Metrics) {
+	if s == nil || version != metrics.SignatureCanonical {
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	for _, m := range ms {
+		delete(s.nonces, m.Nonce)
+	}
+}
+
+// Sign sets the hash of a metric returned to the client.
+func (s *Signer) Sign(version int, m metrics.Metrics) metrics.Metrics {
+	m.Hash, m.Timestamp, m.Nonce = "", 0, ""
+	if s == nil {
+		return m
+	}
+	if version == metrics.SignatureCanonical {
+		m.Timestamp = s.now().Unix()
+		m.Nonce = metrics.NewNonce()
+	}
+	m.Hash = m.ComputeHash(s.key, version)
+	return m
+}
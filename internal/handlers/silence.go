@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"time"
+)
+
+type silenceResponse struct {
+	storage.Silence
+	Status string `json:"status"`
+}
+
+func newSilenceResponse(s storage.Silence, now time.Time) silenceResponse {
+	status := "active"
+	switch {
+	case now.Before(s.StartsAt):
+		status = "pending"
+	case !now.Before(s.EndsAt):
+		status = "expired"
+	}
+	return silenceResponse{Silence: s, Status: status}
+}
+
+func ListSilences(repo storage.SilenceRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		silences, err := repo.ListSilences(r.Context())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		result := make([]silenceResponse, 0, len(silences))
+		for _, s := range silences {
+			result = append(result, newSilenceResponse(s, now))
+		}
+		writeJSON(w, result)
+	}
+}
+
+func GetSilence(repo storage.SilenceRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s, err := repo.GetSilence(r.Context(), chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, err.Error(), statusFromError(err))
+			return
+		}
+		writeJSON(w, newSilenceResponse(s, time.Now()))
+	}
+}
+
+func CreateSilence(repo storage.SilenceRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var s storage.Silence
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		s.ID = storage.NewSilenceID()
+		s.CreatedAt = now
+		if s.StartsAt.IsZero() {
+			s.StartsAt = now
+		}
+		if err := validateSilence(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.SaveSilence(r.Context(), s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		b, _ := json.Marshal(newSilenceResponse(s, now))
+		w.Write(b)
+	}
+}
+
+func UpdateSilence(repo storage.SilenceRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		existing, err := repo.GetSilence(r.Context(), chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, err.Error(), statusFromError(err))
+			return
+		}
+
+		var s storage.Silence
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.ID, s.CreatedAt = existing.ID, existing.CreatedAt
+		if s.StartsAt.IsZero() {
+			s.StartsAt = existing.StartsAt
+		}
+		if err := validateSilence(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := repo.SaveSilence(r.Context(), s); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, newSilenceResponse(s, time.Now()))
+	}
+}
+
+func DeleteSilence(repo storage.SilenceRepository) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := repo.DeleteSilence(r.Context(), chi.URLParam(r, "id")); err != nil {
+			http.Error(w, err.Error(), statusFromError(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func validateSilence(s storage.Silence) error {
+	if s.Matchers.Metric == "" && s.Matchers.MType == "" && len(s.Matchers.Labels) == 0 {
+		return errors.New("silence has no matchers")
+	}
+	if s.Author == "" {
+		return errors.New("silence author is empty")
+	}
+	if !s.EndsAt.After(s.StartsAt) {
+		return errors.New("silence must end after it starts")
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+)
+
+// Accumulator collects metrics between reports. Gauges keep their latest
+// value and counters, which collectors report as increments, are summed
+// until a report containing them is acknowledged. Histograms are merged like
+// counters; one with different buckets replaces the accumulated one.
+type Accumulator struct {
+	mux    sync.Mutex
+	values map[string]Data
+}
+
+func NewAccumulator() *Accumulator {
+	return &Accumulator{values: map[string]Data{}}
+}
+
+func (a *Accumulator) Add(d []Data) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for _, v := range d {
+		key := v.Type + ":" + v.Name
+		if prev, ok := a.values[key]; ok {
+			switch {
+			case v.Type == "counter":
+				v.Value += prev.Value
+			case v.Histogram != nil && prev.Histogram != nil:
+				if h, err := prev.Histogram.Merge(v.Histogram); err == nil {
+					v.Histogram = h
+				}
+			}
+		}
+		a.values[key] = v
+	}
+}
+
+// Snapshot returns the accumulated metrics ordered by type and name without
+// resetting them.
+func (a *Accumulator) Snapshot() []Data {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	result := make([]Data, 0, len(a.values))
+	for _, v := range a.values {
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Type != result[j].Type {
+			return result[i].Type < result[j].Type
+		}
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// Ack marks a snapshot as delivered. Reported counter increments are
+// subtracted, so increments added after the snapshot are kept for the next
+// report, and gauges that have not changed since are dropped.
+func (a *Accumulator) Ack(sent []Data) {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	for _, v := range sent {
+		key := v.Type + ":" + v.Name
+		cur, ok := a.values[key]
+		if !ok {
+			continue
+		}
+		switch {
+		case v.Histogram != nil && cur.Histogram != nil:
+			if cur.Histogram.Equal(v.Histogram) {
+				delete(a.values, key)
+			} else if h, err := cur.Histogram.Sub(v.Histogram); err == nil {
+				cur.Histogram = h
+				a.values[key] = cur
+			}
+		case v.Type != "counter":
+			if cur.Value == v.Value {
+				delete(a.values, key)
+			}
+		case cur.Value == v.Value:
+			delete(a.values, key)
+		default:
+			cur.Value -= v.Value
+			a.values[key] = cur
+		}
+	}
+}
+
+func (a *Accumulator) Len() int {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+
+	return len(a.values)
+}
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestAccumulator(t *testing.T) {
+	a := NewAccumulator()
+	a.Add([]Data{{Name: "PollCount", Type: "counter", Value: 1}, {Name: "Alloc", Type: "gauge", Value: 1}})
+	a.Add([]Data{{Name: "PollCount", Type: "counter", Value: 1}, {Name: "Alloc", Type: "gauge", Value: 2}})
+
+	sent := a.Snapshot()
+	assert.Equal(t, []Data{
+		{Name: "PollCount", Type: "counter", Value: 2},
+		{Name: "Alloc", Type: "gauge", Value: 2},
+	}, sent)
+
+	// Polls between the snapshot and the acknowledgement are not lost.
+	a.Add([]Data{{Name: "PollCount", Type: "counter", Value: 1}})
+	a.Ack(sent)
+	assert.Equal(t, []Data{{Name: "PollCount", Type: "counter", Value: 1}}, a.Snapshot())
+
+	// Without an acknowledgement the counters keep accumulating.
+	a.Add([]Data{{Name: "PollCount", Type: "counter", Value: 1}})
+	assert.Equal(t, []Data{{Name: "PollCount", Type: "counter", Value: 2}}, a.Snapshot())
+
+	a.Ack(a.Snapshot())
+	assert.Equal(t, 0, a.Len())
+}
+
+func TestAccumulator_Histogram(t *testing.T) {
+	observe := func(v ...float64) *Histogram {
+		h := NewHistogram([]float64{1, 2})
+		for _, x := range v {
+			h.Observe(x)
+		}
+		return h
+	}
+
+	a := NewAccumulator()
+	a.Add([]Data{{Name: "Latency", Type: "histogram", Histogram: observe(0.5)}})
+	a.Add([]Data{{Name: "Latency", Type: "histogram", Histogram: observe(1.5, 3)}})
+
+	sent := a.Snapshot()
+	assert.Equal(t, observe(0.5, 1.5, 3), sent[0].Histogram)
+
+	a.Add([]Data{{Name: "Latency", Type: "histogram", Histogram: observe(0.5)}})
+	a.Ack(sent)
+	assert.Equal(t, observe(0.5), a.Snapshot()[0].Histogram)
+
+	a.Ack(a.Snapshot())
+	assert.Equal(t, 0, a.Len())
+}
@@ -0,0 +1,208 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultBuckets are latency buckets in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+var (
+	ErrInvalidHistogram = errors.New("invalid histogram")
+	ErrBucketsMismatch  = errors.New("histogram buckets do not match")
+	ErrEmptyHistogram   = errors.New("histogram has no observations")
+	ErrInvalidQuantile  = errors.New("quantile must be between 0 and 1")
+)
+
+// Histogram counts observations into buckets. Buckets are the upper bounds in
+// increasing order and Counts are cumulative: Counts[i] is the number of
+// observations less than or equal to Buckets[i]. Count also includes the
+// observations above the last bucket.
+type Histogram struct {
+	Buckets []float64 `json:"buckets"`
+	Counts  []uint64  `json:"counts"`
+	Count   uint64    `json:"count"`
+	Sum     float64   `json:"sum"`
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{
+		Buckets: append([]float64(nil), buckets...),
+		Counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	for i, b := range h.Buckets {
+		if v <= b {
+			h.Counts[i]++
+		}
+	}
+	h.Sum += v
+	h.Count++
+}
+
+// Validate checks that the buckets are finite and increasing and that the
+// counts are cumulative.
+func (h *Histogram) Validate() error {
+	if len(h.Buckets) == 0 {
+		return fmt.Errorf("%w: no buckets", ErrInvalidHistogram)
+	}
+	if len(h.Counts) != len(h.Buckets) {
+		return fmt.Errorf("%w: %d counts for %d buckets", ErrInvalidHistogram, len(h.Counts), len(h.Buckets))
+	}
+	for i, b := range h.Buckets {
+		if math.IsNaN(b) || math.IsInf(b, 0) || (i > 0 && b <= h.Buckets[i-1]) {
+			return fmt.Errorf("%w: buckets must be finite and increasing", ErrInvalidHistogram)
+		}
+		if (i > 0 && h.Counts[i] < h.Counts[i-1]) || h.Counts[i] > h.Count {
+			return fmt.Errorf("%w: counts must be cumulative", ErrInvalidHistogram)
+		}
+	}
+	if math.IsNaN(h.Sum) {
+		return fmt.Errorf("%w: sum is NaN", ErrInvalidHistogram)
+	}
+	return nil
+}
+
+func (h *Histogram) Clone() *Histogram {
+	return &Histogram{
+		Buckets: append([]float64(nil), h.Buckets...),
+		Counts:  append([]uint64(nil), h.Counts...),
+		Count:   h.Count,
+		Sum:     h.Sum,
+	}
+}
+
+// Merge returns the histogram of the observations of both h and other.
+func (h *Histogram) Merge(other *Histogram) (*Histogram, error) {
+	if !h.sameBuckets(other) {
+		return nil, ErrBucketsMismatch
+	}
+	r := h.Clone()
+	for i := range r.Counts {
+		r.Counts[i] += other.Counts[i]
+	}
+	r.Count += other.Count
+	r.Sum += other.Sum
+	return r, nil
+}
+
+// Sub returns the histogram of the observations of h that are not in other,
+// which must have been merged into h.
+func (h *Histogram) Sub(other *Histogram) (*Histogram, error) {
+	if !h.sameBuckets(other) {
+		return nil, ErrBucketsMismatch
+	}
+	if other.Count > h.Count {
+		return nil, fmt.Errorf("%w: more observations are subtracted than counted", ErrInvalidHistogram)
+	}
+	r := h.Clone()
+	for i := range r.Counts {
+		r.Counts[i] -= other.Counts[i]
+	}
+	r.Count -= other.Count
+	r.Sum -= other.Sum
+	return r, nil
+}
+
+// Equal reports whether h and other have the same buckets and observations.
+func (h *Histogram) Equal(other *Histogram) bool {
+	if h == nil || other == nil {
+		return h == other
+	}
+	if !h.sameBuckets(other) || h.Count != other.Count || h.Sum != other.Sum {
+		return false
+	}
+	for i := range h.Counts {
+		if h.Counts[i] != other.Counts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *Histogram) sameBuckets(other *Histogram) bool {
+	if len(h.Buckets) != len(other.Buckets) {
+		return false
+	}
+	for i := range h.Buckets {
+		if h.Buckets[i] != other.Buckets[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Quantile estimates the q-quantile by linear interpolation within the
+// bucket it falls into, the way Prometheus' histogram_quantile does. The
+// lowest bucket starts at zero unless its bound is negative, and quantiles
+// above the last bucket are reported as its bound.
+func (h *Histogram) Quantile(q float64) (float64, error) {
+	if math.IsNaN(q) || q < 0 || q > 1 {
+		return 0, ErrInvalidQuantile
+	}
+	if h.Count == 0 {
+		return 0, ErrEmptyHistogram
+	}
+
+	rank := q * float64(h.Count)
+	i := sort.Search(len(h.Counts), func(i int) bool {
+		return float64(h.Counts[i]) >= rank
+	})
+	if i == len(h.Counts) {
+		return h.Buckets[len(h.Buckets)-1], nil
+	}
+
+	lower, below := 0.0, 0.0
+	if i > 0 {
+		lower, below = h.Buckets[i-1], float64(h.Counts[i-1])
+	} else if h.Buckets[0] <= 0 {
+		return h.Buckets[0], nil
+	}
+	upper := h.Buckets[i]
+	in := float64(h.Counts[i]) - below
+	if in == 0 {
+		return upper, nil
+	}
+	return lower + (upper-lower)*(rank-below)/in, nil
+}
+
+// canonical encodes the histogram for canonical signatures.
+func (h *Histogram) canonical() string {
+	var sb strings.Builder
+	for i, b := range h.Buckets {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatFloat(b, 'g', -1, 64))
+		sb.WriteByte(':')
+		sb.WriteString(strconv.FormatUint(h.Counts[i], 10))
+	}
+	fmt.Fprintf(&sb, ";%d;%s", h.Count, strconv.FormatFloat(h.Sum, 'g', -1, 64))
+	return sb.String()
+}
+
+// ParseBuckets parses a comma-separated list of bucket bounds, e.g.
+// "0.1,0.5,1". The bounds are sorted.
+func ParseBuckets(s string) ([]float64, error) {
+	var buckets []float64
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		b, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bucket %q", ErrInvalidHistogram, part)
+		}
+		buckets = append(buckets, b)
+	}
+	sort.Float64s(buckets)
+	return buckets, NewHistogram(buckets).Validate()
+}
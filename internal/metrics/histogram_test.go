@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestHistogram_Quantile(t *testing.T) {
+	h := NewHistogram([]float64{1, 2, 4})
+	for _, v := range []float64{0.5, 1.5, 1.5, 3, 10} {
+		h.Observe(v)
+	}
+	require.NoError(t, h.Validate())
+	assert.Equal(t, []uint64{1, 3, 4}, h.Counts)
+	assert.Equal(t, uint64(5), h.Count)
+
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{q: 0.1, want: 0.5},
+		{q: 0.5, want: 1.75},
+		{q: 0.8, want: 4},
+		{q: 0.99, want: 4},
+	}
+	for _, tt := range tests {
+		got, err := h.Quantile(tt.q)
+		require.NoError(t, err)
+		assert.InDelta(t, tt.want, got, 1e-9, "q=%v", tt.q)
+	}
+
+	_, err := h.Quantile(1.5)
+	assert.ErrorIs(t, err, ErrInvalidQuantile)
+	_, err = NewHistogram([]float64{1}).Quantile(0.5)
+	assert.ErrorIs(t, err, ErrEmptyHistogram)
+}
+
+func TestHistogram_Merge(t *testing.T) {
+	a := NewHistogram([]float64{1, 2})
+	a.Observe(0.5)
+	b := NewHistogram([]float64{1, 2})
+	b.Observe(1.5)
+
+	m, err := a.Merge(b)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{1, 2}, m.Counts)
+	assert.Equal(t, 2.0, m.Sum)
+	assert.Equal(t, uint64(1), a.Count, "merge must not modify its operands")
+
+	_, err = a.Merge(NewHistogram([]float64{1, 3}))
+	assert.ErrorIs(t, err, ErrBucketsMismatch)
+}
+
+func TestParseBuckets(t *testing.T) {
+	b, err := ParseBuckets("0.5, 0.1,1")
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.1, 0.5, 1}, b)
+
+	_, err = ParseBuckets("0.1,0.1")
+	assert.ErrorIs(t, err, ErrInvalidHistogram)
+	_, err = ParseBuckets("")
+	assert.ErrorIs(t, err, ErrInvalidHistogram)
+}
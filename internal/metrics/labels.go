@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels distinguish series sharing a metric id and type, e.g. the same
+// metric reported by different hosts.
+type Labels map[string]string
+
+var ErrInvalidLabels = errors.New("invalid labels")
+
+// String returns the canonical form of the labels, {name="value",...} sorted
+// by name, or an empty string when there are none. Two label sets are equal
+// exactly when their canonical forms are.
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(l))
+	for k := range l {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(l[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// Validate checks that every label name is non-empty and free of the
+// characters used by the canonical form.
+func (l Labels) Validate() error {
+	for k := range l {
+		if k == "" || strings.ContainsAny(k, `{}=,"`) {
+			return fmt.Errorf("%w: label name %q", ErrInvalidLabels, k)
+		}
+	}
+	return nil
+}
+
+// Matches reports whether every matcher label has the same value in l.
+func (l Labels) Matches(matchers Labels) bool {
+	for k, v := range matchers {
+		if lv, ok := l[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge returns l with the labels of other added where l has none.
+func (l Labels) Merge(other Labels) Labels {
+	if len(other) == 0 {
+		return l
+	}
+	result := make(Labels, len(l)+len(other))
+	for k, v := range other {
+		result[k] = v
+	}
+	for k, v := range l {
+		result[k] = v
+	}
+	return result
+}
+
+// ParseLabels parses the canonical form returned by String.
+func ParseLabels(s string) (Labels, error) {
+	if s == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidLabels, s)
+	}
+	rest := s[1 : len(s)-1]
+	l := Labels{}
+	for rest != "" {
+		name, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLabels, s)
+		}
+		quoted, err := strconv.QuotedPrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLabels, s)
+		}
+		l[name], _ = strconv.Unquote(quoted)
+		rest = strings.TrimPrefix(value[len(quoted):], ",")
+	}
+	return l, l.Validate()
+}
+
+// ParseLabelList parses labels given as name=value pairs separated by
+// commas, e.g. "env=prod,region=eu", as used in flags and query strings.
+func ParseLabelList(s string) (Labels, error) {
+	var l Labels
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidLabels, part)
+		}
+		if l == nil {
+			l = Labels{}
+		}
+		l[strings.TrimSpace(name)] = strings.TrimSpace(value)
+	}
+	return l, l.Validate()
+}
+
+// SplitSeries splits a series name such as Alloc{host="a"} into the metric
+// id and its labels.
+func SplitSeries(name string) (string, Labels, error) {
+	i := strings.IndexByte(name, '{')
+	if i < 0 || !strings.HasSuffix(name, "}") {
+		return name, nil, nil
+	}
+	l, err := ParseLabels(name[i:])
+	return name[:i], l, err
+}
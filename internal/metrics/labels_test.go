@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestLabels(t *testing.T) {
+	l := Labels{"host": "web-1", "env": `pro"d`, "region": "eu,west"}
+	s := l.String()
+	assert.Equal(t, `{env="pro\"d",host="web-1",region="eu,west"}`, s)
+
+	parsed, err := ParseLabels(s)
+	require.NoError(t, err)
+	assert.Equal(t, l, parsed)
+
+	id, parsed, err := SplitSeries("Alloc" + s)
+	require.NoError(t, err)
+	assert.Equal(t, "Alloc", id)
+	assert.Equal(t, l, parsed)
+
+	id, parsed, err = SplitSeries("Alloc")
+	require.NoError(t, err)
+	assert.Equal(t, "Alloc", id)
+	assert.Nil(t, parsed)
+
+	assert.True(t, l.Matches(Labels{"host": "web-1"}))
+	assert.True(t, l.Matches(nil))
+	assert.False(t, l.Matches(Labels{"host": "web-2"}))
+	assert.False(t, Labels(nil).Matches(Labels{"host": "web-1"}))
+
+	list, err := ParseLabelList("env=prod, region = eu")
+	require.NoError(t, err)
+	assert.Equal(t, Labels{"env": "prod", "region": "eu"}, list)
+	_, err = ParseLabelList("env")
+	assert.ErrorIs(t, err, ErrInvalidLabels)
+	assert.ErrorIs(t, Labels{"a=b": "c"}.Validate(), ErrInvalidLabels)
+
+	assert.Equal(t, Labels{"host": "a", "env": "prod"}, Labels{"host": "a"}.Merge(Labels{"host": "b", "env": "prod"}))
+}
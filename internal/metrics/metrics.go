@@ -2,90 +2,124 @@ package metrics
 
 import (
 	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
-	"runtime"
+	"strconv"
 )
 
-var (
-	inc int64 = 0
+type Data struct {
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Value     float64    `json:"value"`
+	Histogram *Histogram `json:"histogram,omitempty"`
+	// Timestamp and Nonce are the canonical signature of the first attempt
+	// to send the metric, which retries reuse.
+	Timestamp int64  `json:"ts,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
+}
+
+// Signature versions. Version 1 is the legacy format that rounds gauges to
+// integers; version 2 is canonical, encodes values exactly and covers a
+// timestamp and a nonce against replays.
+const (
+	SignatureLegacy    = 1
+	SignatureCanonical = 2
 )
 
-type Data struct {
-	Name  string  `json:"name"`
-	Type  string  `json:"type"`
-	Value float64 `json:"value"`
+// SignatureVersionHeader carries the signature version of the metrics in a
+// request or response. Requests without it use the legacy version.
+const SignatureVersionHeader = "X-Signature-Version"
+
+// BodyHashHeader carries the hex-encoded HMAC-SHA256 of a request or
+// response body as sent, i.e. after compression.
+const BodyHashHeader = "HashSHA256"
+
+// BodyHash returns the signature of a request or response body.
+func BodyHash(key string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
 }
 
 type Metrics struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	Hash  string   `json:"hash,omitempty"`
+	ID     string   `json:"id"`
+	MType  string   `json:"type"`
+	Labels Labels   `json:"labels,omitempty"`
+	Delta  *int64   `json:"delta,omitempty"`
+	Value  *float64 `json:"value,omitempty"`
+	// Histogram holds the observations of histogram metrics, which are
+	// merged into the stored ones like counter deltas.
+	Histogram *Histogram `json:"histogram,omitempty"`
+	Hash      string     `json:"hash,omitempty"`
+	// Timestamp (unix seconds) and Nonce are only set by canonical
+	// signatures.
+	Timestamp int64  `json:"ts,omitempty"`
+	Nonce     string `json:"nonce,omitempty"`
 }
 
-func CollectMetrics() []Data {
-	var memStats runtime.MemStats
-	runtime.ReadMemStats(&memStats)
-
-	inc++
-	// Create a slice of metrics.
-	metrics := []Data{
-		{Name: "Alloc", Type: "gauge", Value: float64(memStats.Alloc)},
-		{Name: "BuckHashSys", Type: "gauge", Value: float64(memStats.BuckHashSys)},
-		{Name: "Frees", Type: "gauge", Value: float64(memStats.Frees)},
-		{Name: "GCCPUFraction", Type: "gauge", Value: memStats.GCCPUFraction},
-		{Name: "GCSys", Type: "gauge", Value: float64(memStats.GCSys)},
-		{Name: "HeapAlloc", Type: "gauge", Value: float64(memStats.HeapAlloc)},
-		{Name: "HeapIdle", Type: "gauge", Value: float64(memStats.HeapIdle)},
-		{Name: "HeapInuse", Type: "gauge", Value: float64(memStats.HeapInuse)},
-		{Name: "HeapObjects", Type: "gauge", Value: float64(memStats.HeapObjects)},
-		{Name: "HeapReleased", Type: "gauge", Value: float64(memStats.HeapReleased)},
-		{Name: "HeapSys", Type: "gauge", Value: float64(memStats.HeapSys)},
-		{Name: "LastGC", Type: "gauge", Value: float64(memStats.LastGC)},
-		{Name: "Lookups", Type: "gauge", Value: float64(memStats.Lookups)},
-		{Name: "MCacheInuse", Type: "gauge", Value: float64(memStats.MCacheInuse)},
-		{Name: "MCacheSys", Type: "gauge", Value: float64(memStats.MCacheSys)},
-		{Name: "Mallocs", Type: "gauge", Value: float64(memStats.Mallocs)},
-		{Name: "NextGC", Type: "gauge", Value: float64(memStats.NextGC)},
-		{Name: "NumForcedGC", Type: "gauge", Value: float64(memStats.NumForcedGC)},
-		{Name: "NumGC", Type: "gauge", Value: float64(memStats.NumGC)},
-		{Name: "OtherSys", Type: "gauge", Value: float64(memStats.OtherSys)},
-		{Name: "PauseTotalNs", Type: "gauge", Value: float64(memStats.PauseTotalNs)},
-		{Name: "StackInuse", Type: "gauge", Value: float64(memStats.StackInuse)},
-		{Name: "StackSys", Type: "gauge", Value: float64(memStats.StackSys)},
-		{Name: "Sys", Type: "gauge", Value: float64(memStats.Sys)},
-		{Name: "TotalAlloc", Type: "gauge", Value: float64(memStats.TotalAlloc)},
-		{Name: "PollCount", Type: "counter", Value: float64(inc)},
-		{Name: "RandomValue", Type: "gauge", Value: float64(memStats.TotalAlloc)},
+// ComputeHash returns the hex-encoded HMAC-SHA256 of the metric signed with
+// key using the given signature version.
+func (m Metrics) ComputeHash(key string, version int) string {
+	h := hmac.New(sha256.New, []byte(key))
+	if version == SignatureCanonical {
+		h.Write([]byte(m.canonicalMessage()))
+	} else {
+		h.Write([]byte(m.legacyMessage()))
 	}
-
-	return metrics
+	return hex.EncodeToString(h.Sum(nil))
 }
 
-func (m Metrics) IsHashesEquals() (bool, error) {
-	h := hmac.New(sha256.New, []byte("key"))
-
-	data, err := hex.DecodeString(m.Hash)
+// VerifyHash reports whether Hash is the signature of the metric with key.
+func (m Metrics) VerifyHash(key string, version int) bool {
+	got, err := hex.DecodeString(m.Hash)
 	if err != nil {
-		return false, err
+		return false
 	}
+	want, _ := hex.DecodeString(m.ComputeHash(key, version))
+	return hmac.Equal(got, want)
+}
 
-	var msg string
-	if m.MType == "counter" {
-		msg = fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta)
-	} else {
-		msg = fmt.Sprintf("%s:gauge:%.f", m.ID, *m.Value)
+func (m Metrics) legacyMessage() string {
+	switch {
+	case m.MType == "counter" && m.Delta != nil:
+		return fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta)
+	case m.MType == "gauge" && m.Value != nil:
+		return fmt.Sprintf("%s:gauge:%.f", m.ID, *m.Value)
+	default:
+		return fmt.Sprintf("%s:%s", m.ID, m.MType)
 	}
+}
 
-	h.Write([]byte(msg))
-	sign := h.Sum(nil)
+// canonicalMessage lists the fields one per line. Values use the shortest
+// representation that parses back to the same number and free-form fields
+// are length-prefixed so no two metrics share a message. Labels are appended
+// in their canonical form when present, so unlabeled metrics keep their
+// signatures. Legacy signatures do not cover labels.
+func (m Metrics) canonicalMessage() string {
+	var value string
+	switch {
+	case m.MType == "counter" && m.Delta != nil:
+		value = strconv.FormatInt(*m.Delta, 10)
+	case m.MType == "gauge" && m.Value != nil:
+		value = strconv.FormatFloat(*m.Value, 'g', -1, 64)
+	case m.MType == "histogram" && m.Histogram != nil:
+		value = m.Histogram.canonical()
+	}
+	msg := fmt.Sprintf("v2\n%d:%s\n%s\n%s\n%d\n%d:%s",
+		len(m.ID), m.ID, m.MType, value, m.Timestamp, len(m.Nonce), m.Nonce)
+	if labels := m.Labels.String(); labels != "" {
+		msg += fmt.Sprintf("\n%d:%s", len(labels), labels)
+	}
+	return msg
+}
 
-	if hmac.Equal(sign, data) {
-		return true, nil
-	} else {
-		return false, nil
+// NewNonce returns a random nonce for a canonical signature.
+func NewNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
 	}
+	return hex.EncodeToString(b)
 }
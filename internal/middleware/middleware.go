@@ -1,10 +1,22 @@
 package middleware
 
 import (
+	"bytes"
 	"compress/gzip"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/hex"
+	"github.com/eugeniylennik/alertics/internal/encryption"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/telemetry"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func ContentTypeJSON(next http.Handler) http.Handler {
@@ -19,19 +31,10 @@ type gzipWriter struct {
 	Writer io.Writer
 }
 
-type gzipReader struct {
-	http.ResponseWriter
-	Reader io.Reader
-}
-
 func (w gzipWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
-func (r gzipReader) Read(b []byte) (int, error) {
-	return r.Reader.Read(b)
-}
-
 func CompressGzip(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
@@ -53,22 +56,175 @@ func CompressGzip(next http.Handler) http.Handler {
 	})
 }
 
-func DecompressGzip(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+// DefaultMaxDecompressedSize is the default limit of a decompressed request
+// body.
+const DefaultMaxDecompressedSize = 10 << 20
+
+// DecompressGzip replaces gzip-encoded request bodies with their
+// decompressed content. Bodies that decompress to more than maxSize bytes are
+// rejected, so a small compressed request cannot exhaust the memory.
+func DecompressGzip(maxSize int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			reader, err := gzip.NewReader(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer reader.Close()
+
+			b, err := io.ReadAll(io.LimitReader(reader, maxSize+1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if int64(len(b)) > maxSize {
+				http.Error(w, "decompressed body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(b))
+			r.ContentLength = int64(len(b))
+			r.Header.Del("Content-Encoding")
+			r.Header.Set("Content-Length", strconv.Itoa(len(b)))
 			next.ServeHTTP(w, r)
-			return
-		}
-		reader, err := gzip.NewReader(r.Body)
-		if err != nil {
-			_, err := io.WriteString(w, err.Error())
+		})
+	}
+}
+
+// Decrypt replaces request bodies encrypted by the agent with their
+// plaintext. Unencrypted requests pass through, and encrypted ones are
+// rejected when the server has no private key.
+func Decrypt(key *rsa.PrivateKey, maxSize int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme := r.Header.Get(encryption.Header)
+			if scheme == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if key == nil || scheme != encryption.Scheme {
+				http.Error(w, "unsupported body encryption", http.StatusBadRequest)
+				return
+			}
+
+			b, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
 			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
 				return
 			}
-			return
+			if int64(len(b)) > maxSize {
+				http.Error(w, "body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if b, err = encryption.Decrypt(key, b); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(b))
+			r.ContentLength = int64(len(b))
+			r.Header.Del(encryption.Header)
+			r.Header.Set("Content-Length", strconv.Itoa(len(b)))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// TrustedSubnet rejects requests whose X-Real-IP header is missing or
+// outside subnet. A nil subnet allows every request.
+func TrustedSubnet(subnet *net.IPNet) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if subnet == nil {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := net.ParseIP(r.Header.Get("X-Real-IP"))
+			if ip == nil || !subnet.Contains(ip) {
+				http.Error(w, "address is not in the trusted subnet", http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// SignBody signs the request and response bodies with key in the
+// HashSHA256 header. Requests with a body must be signed; the body is read
+// before any decompression, so the signature covers it exactly as sent.
+// Without a key bodies are neither verified nor signed.
+func SignBody(key string, maxSize int64) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if key == "" {
+			return next
 		}
-		defer reader.Close()
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if int64(len(b)) > maxSize {
+				http.Error(w, "body is too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			if len(b) > 0 {
+				got, err := hex.DecodeString(r.Header.Get(metrics.BodyHashHeader))
+				want, _ := hex.DecodeString(metrics.BodyHash(key, b))
+				if err != nil || !hmac.Equal(got, want) {
+					telemetry.HashVerificationFailures.Inc()
+					http.Error(w, "body hash mismatch", http.StatusBadRequest)
+					return
+				}
+			}
+			r.Body = io.NopCloser(bytes.NewReader(b))
+
+			sw := &signedWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+
+			w.Header().Set(metrics.BodyHashHeader, metrics.BodyHash(key, sw.body.Bytes()))
+			w.WriteHeader(sw.status)
+			w.Write(sw.body.Bytes())
+		})
+	}
+}
+
+// signedWriter buffers a response until its signature is known.
+type signedWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
 
-		next.ServeHTTP(gzipReader{ResponseWriter: w, Reader: reader}, r)
+func (w *signedWriter) WriteHeader(status int) {
+	w.status = status
+}
+
+func (w *signedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// Instrument records the number and latency of requests per route pattern,
+// method and status.
+func Instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		telemetry.HTTPRequests.Inc(route, r.Method, strconv.Itoa(status))
+		telemetry.HTTPRequestDuration.Observe(time.Since(start).Seconds(), route, r.Method)
 	})
 }
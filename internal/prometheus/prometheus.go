@@ -0,0 +1,252 @@
+package prometheus
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+type Sample struct {
+	// Suffix is appended to the family name, e.g. "_bucket".
+	Suffix string
+	Labels map[string]string
+	Value  float64
+}
+
+// Family is a set of samples sharing a name and a type.
+type Family struct {
+	Name    string
+	Type    string
+	Help    string
+	Samples []Sample
+}
+
+// FromMetrics groups stored metrics into families named after their ids.
+// Metrics of different types whose ids sanitize to the same name get the type
+// appended to the name, e.g. "cpu_usage_gauge" and "cpu_usage_counter". A
+// series whose sanitized name and labels are already taken by a metric with a
+// smaller id, e.g. "cpu-usage" after "cpu.usage", is logged and skipped.
+func FromMetrics(m []metrics.Metrics) []Family {
+	sorted := append([]metrics.Metrics(nil), m...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+
+	type familyKey struct{ name, mType string }
+	byKey := map[familyKey]*Family{}
+	types := map[string]int{}
+	series := map[string]string{}
+	for _, v := range sorted {
+		key := familyKey{SanitizeName(v.ID), v.MType}
+		f, ok := byKey[key]
+		if !ok {
+			f = &Family{Name: key.name, Type: key.mType}
+			byKey[key] = f
+			types[key.name]++
+		}
+
+		id := key.name + " " + key.mType + v.Labels.String()
+		if other, ok := series[id]; ok {
+			log.Printf("prometheus: skipping %s %s%s, its name collides with %s\n", v.MType, v.ID, v.Labels, other)
+			continue
+		}
+		series[id] = v.ID
+
+		if v.Histogram != nil {
+			f.Samples = append(f.Samples, HistogramSamples(v.Labels, v.Histogram)...)
+			continue
+		}
+		var value float64
+		switch {
+		case v.Value != nil:
+			value = *v.Value
+		case v.Delta != nil:
+			value = float64(*v.Delta)
+		}
+		f.Samples = append(f.Samples, Sample{Labels: v.Labels, Value: value})
+	}
+
+	families := make([]Family, 0, len(byKey))
+	for _, f := range byKey {
+		if types[f.Name] > 1 {
+			f.Name += "_" + SanitizeName(f.Type)
+		}
+		families = append(families, *f)
+	}
+	sort.Slice(families, func(i, j int) bool {
+		if families[i].Name != families[j].Name {
+			return families[i].Name < families[j].Name
+		}
+		return families[i].Type < families[j].Type
+	})
+
+	// A family must not write samples named like those of another one, e.g.
+	// a gauge "latency_bucket" next to a histogram "latency".
+	names := map[string]string{}
+	result := families[:0]
+	for _, f := range families {
+		taken := ""
+		for _, name := range f.sampleNames() {
+			if other, ok := names[name]; ok {
+				taken = other
+				break
+			}
+		}
+		if taken != "" {
+			log.Printf("prometheus: skipping %s family %s, its samples collide with %s\n", f.Type, f.Name, taken)
+			continue
+		}
+		for _, name := range f.sampleNames() {
+			names[name] = f.Name
+		}
+		result = append(result, f)
+	}
+	return result
+}
+
+// sampleNames returns the names of the samples the family writes.
+func (f Family) sampleNames() []string {
+	if f.Type == "histogram" {
+		return []string{f.Name + "_bucket", f.Name + "_sum", f.Name + "_count"}
+	}
+	return []string{f.Name}
+}
+
+// HistogramSamples returns the cumulative _bucket samples, including the +Inf
+// bucket, followed by the _sum and _count samples of h.
+func HistogramSamples(labels map[string]string, h *metrics.Histogram) []Sample {
+	result := make([]Sample, 0, len(h.Buckets)+3)
+	for i, b := range h.Buckets {
+		result = append(result, Sample{
+			Suffix: "_bucket",
+			Labels: WithLabel(labels, "le", strconv.FormatFloat(b, 'g', -1, 64)),
+			Value:  float64(h.Counts[i]),
+		})
+	}
+	return append(result,
+		Sample{Suffix: "_bucket", Labels: WithLabel(labels, "le", "+Inf"), Value: float64(h.Count)},
+		Sample{Suffix: "_sum", Labels: labels, Value: h.Sum},
+		Sample{Suffix: "_count", Labels: labels, Value: float64(h.Count)},
+	)
+}
+
+// WithLabel returns a copy of labels with the label name set to value.
+func WithLabel(labels map[string]string, name, value string) map[string]string {
+	result := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		result[k] = v
+	}
+	result[name] = value
+	return result
+}
+
+// Write renders the families in the text exposition format.
+func Write(w io.Writer, families []Family) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		if f.Help != "" {
+			fmt.Fprintf(bw, "# HELP %s %s\n", f.Name, escapeHelp(f.Help))
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", f.Name, f.Type)
+		for _, s := range f.Samples {
+			bw.WriteString(f.Name)
+			bw.WriteString(s.Suffix)
+			writeLabels(bw, s.Labels)
+			bw.WriteByte(' ')
+			bw.WriteString(formatValue(s.Value))
+			bw.WriteByte('\n')
+		}
+	}
+	return bw.Flush()
+}
+
+// SanitizeName replaces the characters not allowed in metric names with
+// underscores, e.g. "cpu.usage-1" becomes "cpu_usage_1".
+func SanitizeName(name string) string {
+	return sanitize(name, true)
+}
+
+// SanitizeLabelName is like SanitizeName but also rejects colons.
+func SanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+func sanitize(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+	var sb strings.Builder
+	for i, r := range name {
+		valid := r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') ||
+			(allowColon && r == ':') || (i > 0 && r >= '0' && r <= '9')
+		if !valid {
+			if i == 0 && r >= '0' && r <= '9' {
+				sb.WriteByte('_')
+				sb.WriteRune(r)
+				continue
+			}
+			sb.WriteByte('_')
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+func writeLabels(bw *bufio.Writer, labels map[string]string) {
+	if len(labels) == 0 {
+		return
+	}
+	names := make([]string, 0, len(labels))
+	for k := range labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	bw.WriteByte('{')
+	for i, k := range names {
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		bw.WriteString(SanitizeLabelName(k))
+		bw.WriteString(`="`)
+		bw.WriteString(escapeLabelValue(labels[k]))
+		bw.WriteByte('"')
+	}
+	bw.WriteByte('}')
+}
+
+var (
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func escapeLabelValue(v string) string {
+	return labelValueReplacer.Replace(v)
+}
+
+func escapeHelp(v string) string {
+	return helpReplacer.Replace(v)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsNaN(v):
+		return "NaN"
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
@@ -0,0 +1,89 @@
+package prometheus
+
+import (
+	"bytes"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	value := 1.5
+	delta := int64(7)
+	families := FromMetrics([]metrics.Metrics{
+		{ID: "PollCount", MType: "counter", Delta: &delta},
+		{ID: "cpu.usage-1", MType: "gauge", Value: &value},
+	})
+	families = append(families, Family{
+		Name:    "alertics_info",
+		Type:    "gauge",
+		Help:    "Build info.",
+		Samples: []Sample{{Labels: map[string]string{"version": `v"1"`, "go": "1.19"}, Value: math.Inf(1)}},
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, families))
+	assert.Equal(t, `# TYPE PollCount counter
+PollCount 7
+# TYPE cpu_usage_1 gauge
+cpu_usage_1 1.5
+# HELP alertics_info Build info.
+# TYPE alertics_info gauge
+alertics_info{go="1.19",version="v\"1\""} +Inf
+`, buf.String())
+}
+
+func TestWrite_Histogram(t *testing.T) {
+	h := metrics.NewHistogram([]float64{0.1, 1})
+	for _, v := range []float64{0.05, 0.5, 2} {
+		h.Observe(v)
+	}
+	families := FromMetrics([]metrics.Metrics{
+		{ID: "Latency", MType: "histogram", Labels: metrics.Labels{"host": "a"}, Histogram: h},
+	})
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, families))
+	assert.Equal(t, `# TYPE Latency histogram
+Latency_bucket{host="a",le="0.1"} 1
+Latency_bucket{host="a",le="1"} 2
+Latency_bucket{host="a",le="+Inf"} 3
+Latency_sum{host="a"} 2.55
+Latency_count{host="a"} 3
+`, buf.String())
+}
+
+func TestFromMetrics_Collisions(t *testing.T) {
+	one, two := 1.0, 2.0
+	delta := int64(3)
+	h := metrics.NewHistogram([]float64{1})
+	h.Observe(0.5)
+	families := FromMetrics([]metrics.Metrics{
+		{ID: "cpu-usage", MType: "gauge", Value: &two},
+		{ID: "cpu.usage", MType: "gauge", Value: &one},
+		{ID: "cpu.usage", MType: "counter", Delta: &delta},
+		{ID: "Latency", MType: "histogram", Histogram: h},
+		{ID: "Latency_bucket", MType: "gauge", Value: &one},
+	})
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, families))
+	assert.Equal(t, `# TYPE Latency histogram
+Latency_bucket{le="1"} 1
+Latency_bucket{le="+Inf"} 1
+Latency_sum 0.5
+Latency_count 1
+# TYPE cpu_usage_counter counter
+cpu_usage_counter 3
+# TYPE cpu_usage_gauge gauge
+cpu_usage_gauge 2
+`, buf.String())
+}
+
+func TestSanitizeName(t *testing.T) {
+	assert.Equal(t, "HeapAlloc", SanitizeName("HeapAlloc"))
+	assert.Equal(t, "_1st_value", SanitizeName("1st.value"))
+	assert.Equal(t, "disk:read_bytes", SanitizeName("disk:read bytes"))
+	assert.Equal(t, "disk_read", SanitizeLabelName("disk:read"))
+}
@@ -1,46 +1,168 @@
 package router
 
 import (
+	"crypto/rsa"
+	"github.com/eugeniylennik/alertics/internal/alerting"
 	"github.com/eugeniylennik/alertics/internal/handlers"
 	mw "github.com/eugeniylennik/alertics/internal/middleware"
 	"github.com/eugeniylennik/alertics/internal/storage"
-	"github.com/eugeniylennik/alertics/internal/storage/database"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/jackc/pgx/v5/pgxpool"
+	"net"
+	"time"
 )
 
-func NewRouter(store *storage.MemStorage, db *pgxpool.Pool) chi.Router {
+type options struct {
+	engine              *alerting.Engine
+	maxDecompressedSize int64
+	key                 string
+	signatureMaxSkew    time.Duration
+	requireCanonical    bool
+	privateKey          *rsa.PrivateKey
+	trustedSubnet       *net.IPNet
+}
+
+// Option enables optional parts of the API.
+type Option func(o *options)
+
+// WithAlerting exposes the state of the alert rules evaluated by engine.
+func WithAlerting(engine *alerting.Engine) Option {
+	return func(o *options) {
+		o.engine = engine
+	}
+}
+
+// WithMaxDecompressedSize limits the size of gzip-encoded request bodies
+// after decompression.
+func WithMaxDecompressedSize(n int64) Option {
+	return func(o *options) {
+		o.maxDecompressedSize = n
+	}
+}
+
+// WithKey enables signing: request bodies and the metrics received on
+// /update and /updates must be signed with key, and responses and the
+// metrics returned are signed with it.
+func WithKey(key string) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// WithSignatureMaxSkew sets how far the timestamps of canonical signatures
+// may be from the server clock.
+func WithSignatureMaxSkew(d time.Duration) Option {
+	return func(o *options) {
+		o.signatureMaxSkew = d
+	}
+}
+
+// WithRequireCanonicalSignatures rejects metrics with legacy signatures.
+func WithRequireCanonicalSignatures(require bool) Option {
+	return func(o *options) {
+		o.requireCanonical = require
+	}
+}
+
+// WithPrivateKey enables decryption of request bodies encrypted with the
+// public part of key.
+func WithPrivateKey(key *rsa.PrivateKey) Option {
+	return func(o *options) {
+		o.privateKey = key
+	}
+}
+
+// WithTrustedSubnet only accepts metrics from agents whose X-Real-IP is in
+// subnet.
+func WithTrustedSubnet(subnet *net.IPNet) Option {
+	return func(o *options) {
+		o.trustedSubnet = subnet
+	}
+}
+
+func NewRouter(repo storage.Repository, opts ...Option) chi.Router {
+	o := options{maxDecompressedSize: mw.DefaultMaxDecompressedSize}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var signer *handlers.Signer
+	if o.key != "" {
+		signer = handlers.NewSigner(o.key, o.signatureMaxSkew, o.requireCanonical)
+	}
+
 	r := chi.NewRouter()
 
 	r.Use(middleware.DefaultLogger)
 	r.Use(middleware.RequestID)
+	r.Use(mw.Instrument)
 	r.Use(middleware.RealIP)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(middleware.StripSlashes)
 
 	r.Use(mw.ContentTypeJSON)
-	r.Use(mw.CompressGzip)
-	r.Use(mw.DecompressGzip)
 
-	dbStore := database.NewStorage(db)
+	// decodeBody handles compressed and encrypted bodies. The body signature
+	// of metric updates is checked before, so it covers the body as sent.
+	decodeBody := func(r chi.Router) {
+		r.Use(mw.CompressGzip)
+		r.Use(mw.Decrypt(o.privateKey, o.maxDecompressedSize))
+		r.Use(mw.DecompressGzip(o.maxDecompressedSize))
+	}
 
-	r.Get("/", handlers.GetMetrics(store))
-	r.Get("/ping", handlers.HealthCheckDB(db))
+	r.Group(func(r chi.Router) {
+		r.Use(mw.TrustedSubnet(o.trustedSubnet))
+		r.Use(mw.SignBody(o.key, o.maxDecompressedSize))
+		decodeBody(r)
 
-	r.Route("/update", func(r chi.Router) {
-		r.Post("/", handlers.RecordMetricsByJSON(store, dbStore))
-		r.Post("/{type}/{name}/{value}", handlers.RecordMetrics(store))
+		r.Route("/update", func(r chi.Router) {
+			r.Post("/", handlers.RecordMetricsByJSON(repo, signer))
+			r.Post("/{type}/{name}/{value}", handlers.RecordMetrics(repo, signer))
+		})
+		r.Post("/updates", handlers.RecordMetricsBatch(repo, signer))
 	})
 
-	r.Route("/updates", func(r chi.Router) {
-		r.Post("/", handlers.RecordMetricsBatch(dbStore))
-	})
+	r.Group(func(r chi.Router) {
+		decodeBody(r)
+
+		r.Get("/", handlers.GetMetrics(repo))
+		r.Get("/ping", handlers.HealthCheck(repo))
+		r.Get("/metrics", handlers.GetPrometheusMetrics(repo))
+
+		r.Route("/value", func(r chi.Router) {
+			r.Post("/", handlers.GetSpecificMetricJSON(repo, signer))
+			r.Get("/{type}/{name}", handlers.GetSpecificMetric(repo))
+		})
+
+		var silencer *alerting.Silencer
+		silences, ok := storage.As[storage.SilenceRepository](repo)
+		if ok {
+			silencer = alerting.NewSilencer(silences)
+		}
+
+		// Changes to alerts and silences are only accepted from the trusted
+		// subnet, like metric updates.
+		trusted := mw.TrustedSubnet(o.trustedSubnet)
 
-	r.Route("/value", func(r chi.Router) {
-		r.Post("/", handlers.GetSpecificMetricJSON(store, dbStore))
-		r.Get("/{type}/{name}", handlers.GetSpecificMetric(store))
+		r.Route("/api/v1", func(r chi.Router) {
+			r.Get("/query_range", handlers.QueryRange(repo))
+			if o.engine != nil {
+				r.Get("/rules", handlers.ListRules(o.engine))
+				r.Get("/alerts", handlers.ListAlerts(o.engine, silencer))
+				r.With(trusted).Post("/alerts/{rule}/ack", handlers.AcknowledgeAlert(o.engine))
+				r.With(trusted).Delete("/alerts/{rule}/ack", handlers.UnacknowledgeAlert(o.engine))
+			}
+			if silences != nil {
+				r.Route("/silences", func(r chi.Router) {
+					r.Get("/", handlers.ListSilences(silences))
+					r.With(trusted).Post("/", handlers.CreateSilence(silences))
+					r.Get("/{id}", handlers.GetSilence(silences))
+					r.With(trusted).Put("/{id}", handlers.UpdateSilence(silences))
+					r.With(trusted).Delete("/{id}", handlers.DeleteSilence(silences))
+				})
+			}
+		})
 	})
 	return r
 }
@@ -0,0 +1,28 @@
+package rpc
+
+import (
+	"encoding/json"
+	"google.golang.org/grpc/encoding"
+)
+
+// CodecName is the content subtype of the JSON codec. Messages are the same
+// JSON documents the HTTP API uses, so the service needs no generated code.
+const CodecName = "json"
+
+func init() {
+	encoding.RegisterCodec(codec{})
+}
+
+type codec struct{}
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (codec) Name() string {
+	return CodecName
+}
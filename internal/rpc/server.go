@@ -0,0 +1,321 @@
+package rpc
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/handlers"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/eugeniylennik/alertics/internal/telemetry"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type options struct {
+	key              string
+	signatureMaxSkew time.Duration
+	requireCanonical bool
+	trustedSubnet    *net.IPNet
+	tls              *tls.Config
+}
+
+// Option configures the gRPC server like the router options configure the
+// HTTP API.
+type Option func(o *options)
+
+// WithKey enables signing: received metrics must be signed with key and the
+// returned ones are signed with it.
+func WithKey(key string) Option {
+	return func(o *options) {
+		o.key = key
+	}
+}
+
+// WithSignatureMaxSkew sets how far the timestamps of canonical signatures
+// may be from the server clock.
+func WithSignatureMaxSkew(d time.Duration) Option {
+	return func(o *options) {
+		o.signatureMaxSkew = d
+	}
+}
+
+// WithRequireCanonicalSignatures rejects metrics with legacy signatures.
+func WithRequireCanonicalSignatures(require bool) Option {
+	return func(o *options) {
+		o.requireCanonical = require
+	}
+}
+
+// WithTrustedSubnet only accepts metrics from agents whose x-real-ip is in
+// subnet.
+func WithTrustedSubnet(subnet *net.IPNet) Option {
+	return func(o *options) {
+		o.trustedSubnet = subnet
+	}
+}
+
+// WithTLS serves over TLS with cfg.
+func WithTLS(cfg *tls.Config) Option {
+	return func(o *options) {
+		o.tls = cfg
+	}
+}
+
+// ingestion lists the methods that store metrics.
+var ingestion = map[string]bool{
+	"/" + serviceName + "/UpdateMetric":       true,
+	"/" + serviceName + "/UpdateMetricsBatch": true,
+}
+
+// NewServer returns a gRPC server of the metrics service backed by repo.
+func NewServer(repo storage.Repository, opts ...Option) *grpc.Server {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var signer *handlers.Signer
+	if o.key != "" {
+		signer = handlers.NewSigner(o.key, o.signatureMaxSkew, o.requireCanonical)
+	}
+
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(TrustedSubnetUnary(o.trustedSubnet), SigningUnary(signer)),
+		grpc.ChainStreamInterceptor(TrustedSubnetStream(o.trustedSubnet), SigningStream(signer)),
+	}
+	if o.tls != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(o.tls)))
+	}
+
+	s := grpc.NewServer(serverOpts...)
+	s.RegisterService(&ServiceDesc, &Server{repo: repo})
+	return s
+}
+
+// Server implements MetricsServer on a repository. Signatures and the
+// trusted subnet are checked by the interceptors.
+type Server struct {
+	repo storage.Repository
+}
+
+func (s *Server) UpdateMetric(ctx context.Context, m *metrics.Metrics) (*metrics.Metrics, error) {
+	if err := storage.Validate(*m); err != nil {
+		return nil, statusFromError(err)
+	}
+	result, err := s.repo.UpsertMetric(ctx, *m)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &result, nil
+}
+
+func (s *Server) UpdateMetricsBatch(stream UpdateMetricsBatchServer) error {
+	var batch []metrics.Metrics
+	for {
+		m, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := storage.Validate(*m); err != nil {
+			return statusFromError(err)
+		}
+		batch = append(batch, *m)
+	}
+
+	telemetry.BatchSize.Observe(float64(len(batch)))
+
+	result, err := s.repo.UpsertMetrics(stream.Context(), batch)
+	if err != nil {
+		return statusFromError(err)
+	}
+	return stream.SendAndClose(&MetricList{Metrics: result})
+}
+
+func (s *Server) GetMetric(ctx context.Context, req *MetricRequest) (*metrics.Metrics, error) {
+	result, err := storage.FindMetric(ctx, s.repo, req.MType, req.ID, req.Labels)
+	if errors.Is(err, storage.ErrInvalidType) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &result, nil
+}
+
+func (s *Server) ListMetrics(ctx context.Context, req *ListRequest) (*MetricList, error) {
+	result, err := s.repo.ListMetrics(ctx)
+	if err != nil {
+		return nil, statusFromError(err)
+	}
+	return &MetricList{Metrics: storage.FilterMetrics(result, req.Labels)}, nil
+}
+
+func statusFromError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, storage.ErrInvalidType):
+		return status.Error(codes.Unimplemented, err.Error())
+	case errors.Is(err, storage.ErrEmptyValue), errors.Is(err, storage.ErrInvalidID), errors.Is(err, metrics.ErrInvalidLabels),
+		errors.Is(err, storage.ErrAmbiguousSeries), errors.Is(err, metrics.ErrInvalidHistogram):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, metrics.ErrBucketsMismatch):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
+
+// TrustedSubnetUnary rejects calls of ingestion methods whose x-real-ip is
+// missing or outside subnet. A nil subnet allows every call.
+func TrustedSubnetUnary(subnet *net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if err := checkSubnet(ctx, subnet, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// TrustedSubnetStream is the streaming counterpart of TrustedSubnetUnary.
+func TrustedSubnetStream(subnet *net.IPNet) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkSubnet(ss.Context(), subnet, info.FullMethod); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+func checkSubnet(ctx context.Context, subnet *net.IPNet, method string) error {
+	if subnet == nil || !ingestion[method] {
+		return nil
+	}
+	ip := net.ParseIP(metadataValue(ctx, RealIPKey))
+	if ip == nil || !subnet.Contains(ip) {
+		return status.Error(codes.PermissionDenied, "address is not in the trusted subnet")
+	}
+	return nil
+}
+
+// SigningUnary verifies the signatures of received metrics and signs the
+// returned ones with the signature version requested in the call metadata.
+// A nil signer disables signing.
+func SigningUnary(signer *handlers.Signer) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		version, err := signatureVersion(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if err := verify(signer, version, req); err != nil {
+			return nil, err
+		}
+		resp, err := handler(ctx, req)
+		if err != nil {
+			if m, ok := req.(*metrics.Metrics); ok {
+				signer.Release(version, *m)
+			}
+			return nil, err
+		}
+		if err := grpc.SetHeader(ctx, metadata.Pairs(SignatureVersionKey, strconv.Itoa(version))); err != nil {
+			return nil, err
+		}
+		sign(signer, version, resp)
+		return resp, nil
+	}
+}
+
+// SigningStream is the streaming counterpart of SigningUnary.
+func SigningStream(signer *handlers.Signer) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		version, err := signatureVersion(ss.Context())
+		if err != nil {
+			return err
+		}
+		if err := ss.SetHeader(metadata.Pairs(SignatureVersionKey, strconv.Itoa(version))); err != nil {
+			return err
+		}
+		signed := &signedStream{ServerStream: ss, signer: signer, version: version}
+		if err := handler(srv, signed); err != nil {
+			signer.Release(version, signed.received...)
+			return err
+		}
+		return nil
+	}
+}
+
+// signedStream verifies received metrics and keeps them so that their nonces
+// can be released when the call fails.
+type signedStream struct {
+	grpc.ServerStream
+	signer   *handlers.Signer
+	version  int
+	received []metrics.Metrics
+}
+
+func (s *signedStream) RecvMsg(m interface{}) error {
+	if err := s.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	if err := verify(s.signer, s.version, m); err != nil {
+		return err
+	}
+	if v, ok := m.(*metrics.Metrics); ok {
+		s.received = append(s.received, *v)
+	}
+	return nil
+}
+
+func (s *signedStream) SendMsg(m interface{}) error {
+	sign(s.signer, s.version, m)
+	return s.ServerStream.SendMsg(m)
+}
+
+func signatureVersion(ctx context.Context) (int, error) {
+	version, err := handlers.ParseSignatureVersion(metadataValue(ctx, SignatureVersionKey))
+	if err != nil {
+		return 0, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return version, nil
+}
+
+func verify(signer *handlers.Signer, version int, msg interface{}) error {
+	m, ok := msg.(*metrics.Metrics)
+	if !ok {
+		return nil
+	}
+	if err := signer.Verify(version, *m); err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return nil
+}
+
+func sign(signer *handlers.Signer, version int, msg interface{}) {
+	switch v := msg.(type) {
+	case *metrics.Metrics:
+		*v = signer.Sign(version, *v)
+	case *MetricList:
+		for i := range v.Metrics {
+			v.Metrics[i] = signer.Sign(version, v.Metrics[i])
+		}
+	}
+}
+
+func metadataValue(ctx context.Context, key string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
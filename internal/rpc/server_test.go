@@ -0,0 +1,130 @@
+package rpc
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, repo storage.Repository, opts ...Option) *MetricsClient {
+	l := bufconn.Listen(1 << 20)
+	s := NewServer(repo, opts...)
+	go s.Serve(l)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return l.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithDefaultCallOptions(grpc.CallContentSubtype(CodecName)),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return NewMetricsClient(conn)
+}
+
+func TestServer(t *testing.T) {
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	c := newTestClient(t, repo)
+	ctx := context.Background()
+
+	value := 1.5
+	m, err := c.UpdateMetric(ctx, &metrics.Metrics{ID: "Alloc", MType: storage.Gauge, Value: &value})
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+
+	delta := int64(2)
+	counter := metrics.Metrics{ID: "PollCount", MType: storage.Counter, Delta: &delta}
+	l, err := c.UpdateMetricsBatch(ctx, []metrics.Metrics{counter, counter})
+	require.NoError(t, err)
+	require.Len(t, l.Metrics, 2)
+	assert.Equal(t, int64(4), *l.Metrics[1].Delta)
+
+	m, err = c.GetMetric(ctx, &MetricRequest{ID: "PollCount", MType: storage.Counter})
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), *m.Delta)
+
+	_, err = c.GetMetric(ctx, &MetricRequest{ID: "Missing", MType: storage.Gauge})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	_, err = c.UpdateMetric(ctx, &metrics.Metrics{ID: "Alloc", MType: storage.Gauge})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	l, err = c.ListMetrics(ctx, &ListRequest{})
+	require.NoError(t, err)
+	assert.Len(t, l.Metrics, 2)
+}
+
+func TestServer_Signing(t *testing.T) {
+	const key = "secret"
+	repo := storage.NewMemStorage(storage.DefaultHistorySize)
+	c := newTestClient(t, repo, WithKey(key))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), SignatureVersionKey, strconv.Itoa(metrics.SignatureCanonical))
+
+	signed := func(id string, delta int64) metrics.Metrics {
+		m := metrics.Metrics{ID: id, MType: storage.Counter, Delta: &delta, Timestamp: time.Now().Unix(), Nonce: metrics.NewNonce()}
+		m.Hash = m.ComputeHash(key, metrics.SignatureCanonical)
+		return m
+	}
+
+	var header metadata.MD
+	l, err := c.UpdateMetricsBatch(ctx, []metrics.Metrics{signed("PollCount", 1), signed("Other", 1)}, grpc.Header(&header))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2"}, header.Get(SignatureVersionKey))
+	for _, m := range l.Metrics {
+		assert.True(t, m.VerifyHash(key, metrics.SignatureCanonical))
+	}
+
+	// A replayed metric rejects the whole batch.
+	replayed := signed("PollCount", 1)
+	_, err = c.UpdateMetric(ctx, &replayed)
+	require.NoError(t, err)
+	_, err = c.UpdateMetricsBatch(ctx, []metrics.Metrics{signed("PollCount", 1), replayed})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	m, err := repo.GetMetric(context.Background(), storage.Counter, "PollCount", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), *m.Delta)
+
+	unsigned := signed("PollCount", 1)
+	unsigned.Hash = ""
+	_, err = c.UpdateMetric(ctx, &unsigned)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+}
+
+func TestServer_TrustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("10.0.0.0/8")
+	require.NoError(t, err)
+	c := newTestClient(t, storage.NewMemStorage(storage.DefaultHistorySize), WithTrustedSubnet(subnet))
+
+	value := 1.0
+	m := &metrics.Metrics{ID: "Alloc", MType: storage.Gauge, Value: &value}
+
+	_, err = c.UpdateMetric(context.Background(), m)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx := metadata.AppendToOutgoingContext(context.Background(), RealIPKey, "192.168.1.1")
+	_, err = c.UpdateMetricsBatch(ctx, []metrics.Metrics{*m})
+	assert.Equal(t, codes.PermissionDenied, status.Code(err))
+
+	ctx = metadata.AppendToOutgoingContext(context.Background(), RealIPKey, "10.1.2.3")
+	_, err = c.UpdateMetric(ctx, m)
+	assert.NoError(t, err)
+
+	// Queries are not restricted.
+	_, err = c.ListMetrics(context.Background(), &ListRequest{})
+	assert.NoError(t, err)
+}
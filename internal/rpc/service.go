@@ -0,0 +1,163 @@
+package rpc
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"google.golang.org/grpc"
+)
+
+// Metadata keys mirroring the HTTP headers of the same name.
+const (
+	SignatureVersionKey = "x-signature-version"
+	RealIPKey           = "x-real-ip"
+)
+
+const serviceName = "alertics.Metrics"
+
+// MetricRequest identifies a metric. Labels are matchers resolved like on
+// the HTTP /value endpoint.
+type MetricRequest struct {
+	ID     string         `json:"id"`
+	MType  string         `json:"type"`
+	Labels metrics.Labels `json:"labels,omitempty"`
+}
+
+// ListRequest lists the metrics whose labels match Labels.
+type ListRequest struct {
+	Labels metrics.Labels `json:"labels,omitempty"`
+}
+
+type MetricList struct {
+	Metrics []metrics.Metrics `json:"metrics"`
+}
+
+// MetricsServer is the server API of the metrics service.
+type MetricsServer interface {
+	UpdateMetric(ctx context.Context, m *metrics.Metrics) (*metrics.Metrics, error)
+	// UpdateMetricsBatch receives a stream of metrics and stores them at once
+	// when the client closes it.
+	UpdateMetricsBatch(stream UpdateMetricsBatchServer) error
+	GetMetric(ctx context.Context, req *MetricRequest) (*metrics.Metrics, error)
+	ListMetrics(ctx context.Context, req *ListRequest) (*MetricList, error)
+}
+
+type UpdateMetricsBatchServer interface {
+	Recv() (*metrics.Metrics, error)
+	SendAndClose(*MetricList) error
+	grpc.ServerStream
+}
+
+type updateMetricsBatchServer struct {
+	grpc.ServerStream
+}
+
+func (s *updateMetricsBatchServer) Recv() (*metrics.Metrics, error) {
+	m := new(metrics.Metrics)
+	if err := s.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *updateMetricsBatchServer) SendAndClose(l *MetricList) error {
+	return s.SendMsg(l)
+}
+
+// ServiceDesc describes the metrics service for grpc.Server.RegisterService.
+var ServiceDesc = grpc.ServiceDesc{
+	ServiceName: serviceName,
+	HandlerType: (*MetricsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{MethodName: "UpdateMetric", Handler: unaryHandler("/"+serviceName+"/UpdateMetric", func(srv MetricsServer, ctx context.Context, m *metrics.Metrics) (interface{}, error) {
+			return srv.UpdateMetric(ctx, m)
+		})},
+		{MethodName: "GetMetric", Handler: unaryHandler("/"+serviceName+"/GetMetric", func(srv MetricsServer, ctx context.Context, req *MetricRequest) (interface{}, error) {
+			return srv.GetMetric(ctx, req)
+		})},
+		{MethodName: "ListMetrics", Handler: unaryHandler("/"+serviceName+"/ListMetrics", func(srv MetricsServer, ctx context.Context, req *ListRequest) (interface{}, error) {
+			return srv.ListMetrics(ctx, req)
+		})},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName: "UpdateMetricsBatch",
+			Handler: func(srv interface{}, stream grpc.ServerStream) error {
+				return srv.(MetricsServer).UpdateMetricsBatch(&updateMetricsBatchServer{stream})
+			},
+			ClientStreams: true,
+		},
+	},
+}
+
+// unaryHandler adapts a typed method to grpc.MethodDesc, running the
+// server's interceptors around it.
+func unaryHandler[T any](fullMethod string, call func(srv MetricsServer, ctx context.Context, req *T) (interface{}, error)) func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	return func(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+		req := new(T)
+		if err := dec(req); err != nil {
+			return nil, err
+		}
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			return call(srv.(MetricsServer), ctx, req.(*T))
+		}
+		if interceptor == nil {
+			return handler(ctx, req)
+		}
+		return interceptor(ctx, req, &grpc.UnaryServerInfo{Server: srv, FullMethod: fullMethod}, handler)
+	}
+}
+
+// MetricsClient is the client API of the metrics service.
+type MetricsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewMetricsClient(cc grpc.ClientConnInterface) *MetricsClient {
+	return &MetricsClient{cc: cc}
+}
+
+func (c *MetricsClient) UpdateMetric(ctx context.Context, m *metrics.Metrics, opts ...grpc.CallOption) (*metrics.Metrics, error) {
+	out := new(metrics.Metrics)
+	if err := c.cc.Invoke(ctx, "/"+serviceName+"/UpdateMetric", m, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UpdateMetricsBatch streams m and returns the stored metrics.
+func (c *MetricsClient) UpdateMetricsBatch(ctx context.Context, m []metrics.Metrics, opts ...grpc.CallOption) (*MetricList, error) {
+	stream, err := c.cc.NewStream(ctx, &ServiceDesc.Streams[0], "/"+serviceName+"/UpdateMetricsBatch", opts...)
+	if err != nil {
+		return nil, err
+	}
+	for i := range m {
+		if err := stream.SendMsg(&m[i]); err != nil {
+			// The server closed the stream; RecvMsg returns its status.
+			break
+		}
+	}
+	if err := stream.CloseSend(); err != nil {
+		return nil, err
+	}
+	out := new(MetricList)
+	if err := stream.RecvMsg(out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *MetricsClient) GetMetric(ctx context.Context, req *MetricRequest, opts ...grpc.CallOption) (*metrics.Metrics, error) {
+	out := new(metrics.Metrics)
+	if err := c.cc.Invoke(ctx, "/"+serviceName+"/GetMetric", req, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *MetricsClient) ListMetrics(ctx context.Context, req *ListRequest, opts ...grpc.CallOption) (*MetricList, error) {
+	out := new(MetricList)
+	if err := c.cc.Invoke(ctx, "/"+serviceName+"/ListMetrics", req, out, opts...); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -0,0 +1,290 @@
+package spool
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const ext = ".json"
+
+// Queue is a FIFO of metric batches persisted in a directory, one file per
+// batch, so batches that could not be delivered survive agent restarts.
+// Files are written to a temporary name and renamed into place, so a crash
+// never leaves a partial batch behind.
+//
+// When the queue grows past maxSize bytes the two oldest batches are merged:
+// counters are summed and gauges keep the newer value, trading resolution for
+// space without losing counter increments.
+type Queue struct {
+	mux     sync.Mutex
+	dir     string
+	maxSize int64
+	files   []entry
+	size    int64
+	next    uint64
+}
+
+type entry struct {
+	seq  uint64
+	size int64
+}
+
+// Open opens the queue in dir, creating it if needed, and picks up the
+// batches left by a previous run.
+func Open(dir string, maxSize int64) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &Queue{dir: dir, maxSize: maxSize, next: 1}
+	for _, de := range des {
+		name := de.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Leftover of an interrupted write.
+			if err := os.Remove(filepath.Join(dir, name)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, ext), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.files = append(q.files, entry{seq: seq, size: info.Size()})
+		q.size += info.Size()
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+	sort.Slice(q.files, func(i, j int) bool {
+		return q.files[i].seq < q.files[j].seq
+	})
+	return q, nil
+}
+
+// Len returns the number of queued batches.
+func (q *Queue) Len() int {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return len(q.files)
+}
+
+// Size returns the total size of the queued batches in bytes.
+func (q *Queue) Size() int64 {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	return q.size
+}
+
+// Push appends a batch to the end of the queue.
+func (q *Queue) Push(d []metrics.Data) error {
+	if len(d) == 0 {
+		return nil
+	}
+
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	e, err := q.write(q.next, d)
+	if err != nil {
+		return err
+	}
+	q.next++
+	q.files = append(q.files, e)
+	q.size += e.size
+
+	for q.maxSize > 0 && q.size > q.maxSize && len(q.files) > 1 {
+		if err := q.mergeOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Peek returns the oldest batch without removing it. Batches that cannot be
+// decoded are dropped.
+func (q *Queue) Peek() ([]metrics.Data, bool, error) {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	for len(q.files) > 0 {
+		d, err := q.read(q.files[0].seq)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			log.Printf("dropping corrupt spooled batch %d: %v\n", q.files[0].seq, err)
+			if err := q.remove(0); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		return d, true, nil
+	}
+	return nil, false, nil
+}
+
+// Pop removes the oldest batch.
+func (q *Queue) Pop() error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.files) == 0 {
+		return nil
+	}
+	return q.remove(0)
+}
+
+// ReplaceOldest replaces the oldest batch with d, e.g. with the part of it
+// that is still to be delivered.
+func (q *Queue) ReplaceOldest(d []metrics.Data) error {
+	q.mux.Lock()
+	defer q.mux.Unlock()
+
+	if len(q.files) == 0 {
+		return nil
+	}
+	if len(d) == 0 {
+		return q.remove(0)
+	}
+	e, err := q.write(q.files[0].seq, d)
+	if err != nil {
+		return err
+	}
+	q.size += e.size - q.files[0].size
+	q.files[0] = e
+	return nil
+}
+
+// mergeOldest merges the oldest batch into the second oldest one.
+func (q *Queue) mergeOldest() error {
+	older, err := q.read(q.files[0].seq)
+	if err != nil {
+		return err
+	}
+	newer, err := q.read(q.files[1].seq)
+	if err != nil {
+		return err
+	}
+
+	e, err := q.write(q.files[1].seq, Merge(older, newer))
+	if err != nil {
+		return err
+	}
+	q.size += e.size - q.files[1].size
+	q.files[1] = e
+	return q.remove(0)
+}
+
+// Merge combines two batches: counters are summed, histograms are merged and
+// gauges take the value from newer. Histograms with different buckets cannot
+// be merged and are both kept. The order of first appearance is preserved.
+// Summed and merged metrics carry new values, so they lose the signature of
+// their earlier attempts.
+func Merge(older, newer []metrics.Data) []metrics.Data {
+	result := make([]metrics.Data, 0, len(older)+len(newer))
+	index := map[string]int{}
+	for _, batch := range [][]metrics.Data{older, newer} {
+		for _, v := range batch {
+			key := v.Type + ":" + v.Name
+			i, ok := index[key]
+			switch {
+			case !ok:
+				index[key] = len(result)
+				result = append(result, v)
+			case v.Type == storage.Counter:
+				result[i].Value += v.Value
+				result[i].Timestamp, result[i].Nonce = 0, ""
+			case v.Type == storage.Histogram:
+				h, err := result[i].Histogram.Merge(v.Histogram)
+				if err != nil {
+					index[key] = len(result)
+					result = append(result, v)
+					continue
+				}
+				result[i].Histogram = h
+				result[i].Timestamp, result[i].Nonce = 0, ""
+			default:
+				result[i] = v
+			}
+		}
+	}
+	return result
+}
+
+func (q *Queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, ext))
+}
+
+func (q *Queue) read(seq uint64) ([]metrics.Data, error) {
+	b, err := os.ReadFile(q.path(seq))
+	if err != nil {
+		return nil, err
+	}
+	var d []metrics.Data
+	if err := json.Unmarshal(b, &d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (q *Queue) write(seq uint64, d []metrics.Data) (entry, error) {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return entry{}, err
+	}
+
+	tmp := q.path(seq) + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return entry{}, err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return entry{}, err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return entry{}, err
+	}
+	if err := f.Close(); err != nil {
+		return entry{}, err
+	}
+	if err := os.Rename(tmp, q.path(seq)); err != nil {
+		return entry{}, err
+	}
+	return entry{seq: seq, size: int64(len(b))}, nil
+}
+
+func (q *Queue) remove(i int) error {
+	if err := os.Remove(q.path(q.files[i].seq)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	q.size -= q.files[i].size
+	q.files = append(q.files[:i], q.files[i+1:]...)
+	return nil
+}
@@ -0,0 +1,104 @@
+package spool
+
+import (
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestQueue_FIFOAcrossRestarts(t *testing.T) {
+	dir := t.TempDir()
+	q, err := Open(dir, 0)
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		require.NoError(t, q.Push([]metrics.Data{{Name: "PollCount", Type: "counter", Value: float64(i)}}))
+	}
+	tmp := filepath.Join(dir, "00000000000000000009.json.tmp")
+	require.NoError(t, os.WriteFile(tmp, []byte("[{"), 0644))
+
+	q, err = Open(dir, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, q.Len())
+	assert.NoFileExists(t, tmp)
+
+	for i := 1; i <= 3; i++ {
+		d, ok, err := q.Peek()
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, float64(i), d[0].Value)
+		require.NoError(t, q.Pop())
+	}
+	_, ok, err := q.Peek()
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, int64(0), q.Size())
+}
+
+func TestQueue_MergesWhenFull(t *testing.T) {
+	q, err := Open(t.TempDir(), 150)
+	require.NoError(t, err)
+
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, q.Push([]metrics.Data{
+			{Name: "PollCount", Type: "counter", Value: 1},
+			{Name: "Alloc", Type: "gauge", Value: float64(i)},
+		}))
+	}
+	assert.Equal(t, 1, q.Len())
+	assert.LessOrEqual(t, q.Size(), int64(150))
+
+	d, ok, err := q.Peek()
+	require.NoError(t, err)
+	require.True(t, ok)
+	assert.Equal(t, []metrics.Data{
+		{Name: "PollCount", Type: "counter", Value: 4},
+		{Name: "Alloc", Type: "gauge", Value: 4},
+	}, d)
+}
+
+func TestMerge_Histogram(t *testing.T) {
+	observe := func(buckets []float64, v ...float64) *metrics.Histogram {
+		h := metrics.NewHistogram(buckets)
+		for _, x := range v {
+			h.Observe(x)
+		}
+		return h
+	}
+	older := []metrics.Data{{Name: "Latency", Type: "histogram", Histogram: observe([]float64{1, 2}, 0.5, 3)}}
+	newer := []metrics.Data{{Name: "Latency", Type: "histogram", Histogram: observe([]float64{1, 2}, 1.5)}}
+
+	d := Merge(older, newer)
+	require.Len(t, d, 1)
+	h := d[0].Histogram
+	assert.Equal(t, uint64(3), h.Count)
+	assert.Equal(t, 5.0, h.Sum)
+	assert.Equal(t, []uint64{1, 2}, h.Counts)
+
+	// Histograms with other buckets are kept as they are.
+	other := []metrics.Data{{Name: "Latency", Type: "histogram", Histogram: observe([]float64{5}, 1)}}
+	d = Merge(d, other)
+	require.Len(t, d, 2)
+	assert.Equal(t, h, d[0].Histogram)
+	assert.Equal(t, other[0].Histogram, d[1].Histogram)
+}
+
+func TestMerge_Signatures(t *testing.T) {
+	older := []metrics.Data{
+		{Name: "PollCount", Type: "counter", Value: 1, Timestamp: 1, Nonce: "a"},
+		{Name: "Alloc", Type: "gauge", Value: 1, Timestamp: 1, Nonce: "b"},
+	}
+	newer := []metrics.Data{
+		{Name: "PollCount", Type: "counter", Value: 2, Timestamp: 2, Nonce: "c"},
+		{Name: "Alloc", Type: "gauge", Value: 2, Timestamp: 2, Nonce: "d"},
+	}
+
+	// Summed counters are new values; gauges are the newer metric.
+	assert.Equal(t, []metrics.Data{
+		{Name: "PollCount", Type: "counter", Value: 3},
+		{Name: "Alloc", Type: "gauge", Value: 2, Timestamp: 2, Nonce: "d"},
+	}, Merge(older, newer))
+}
@@ -0,0 +1,88 @@
+package database
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"time"
+)
+
+func (s *Storage) QueryRollups(ctx context.Context, mType, id string, labels metrics.Labels, resolution time.Duration, from, to time.Time) ([]storage.Rollup, error) {
+	if _, err := s.GetMetric(ctx, mType, id, labels); err != nil {
+		return nil, err
+	}
+	l, err := marshalLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	q := `
+        SELECT ts, count, min, max, sum, last
+        FROM "public".metric_rollups
+        WHERE id=$1 AND type=$2 AND labels=$3 AND resolution=$4 AND ts BETWEEN $5 AND $6
+        ORDER BY ts
+        `
+	rows, err := s.Query(ctx, q, id, mType, l, int64(resolution.Seconds()), from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []storage.Rollup
+	for rows.Next() {
+		var r storage.Rollup
+		if err := rows.Scan(&r.Timestamp, &r.Count, &r.Min, &r.Max, &r.Sum, &r.Last); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+func (s *Storage) SaveRollups(ctx context.Context, mType, id string, labels metrics.Labels, resolution time.Duration, r []storage.Rollup) error {
+	l, err := marshalLabels(labels)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	q := `
+        INSERT INTO public."metric_rollups" (id, type, labels, resolution, ts, count, min, max, sum, last)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        ON CONFLICT (id, type, labels, resolution, ts) DO UPDATE
+        SET count = excluded.count,
+            min = excluded.min,
+            max = excluded.max,
+            sum = excluded.sum,
+            last = excluded.last`
+
+	_, err = tx.Prepare(ctx, "save-rollups", q)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range r {
+		_, err = tx.Exec(ctx, "save-rollups",
+			id, mType, l, int64(resolution.Seconds()), v.Timestamp, v.Count, v.Min, v.Max, v.Sum, v.Last)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *Storage) DeleteBefore(ctx context.Context, resolution time.Duration, before time.Time) error {
+	if resolution == 0 {
+		_, err := s.Exec(ctx, `DELETE FROM "public".metric_samples WHERE ts < $1`, before)
+		return err
+	}
+	_, err := s.Exec(ctx, `DELETE FROM "public".metric_rollups WHERE resolution=$1 AND ts < $2`,
+		int64(resolution.Seconds()), before)
+	return err
+}
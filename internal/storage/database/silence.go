@@ -0,0 +1,87 @@
+package database
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/jackc/pgx/v5"
+)
+
+func (s *Storage) SaveSilence(ctx context.Context, silence storage.Silence) error {
+	matchers, err := json.Marshal(silence.Matchers)
+	if err != nil {
+		return err
+	}
+	q := `
+        INSERT INTO public."silences" (id, matchers, starts_at, ends_at, author, comment, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (id) DO UPDATE
+        SET matchers = excluded.matchers,
+            starts_at = excluded.starts_at,
+            ends_at = excluded.ends_at,
+            author = excluded.author,
+            comment = excluded.comment`
+	_, err = s.Exec(ctx, q, silence.ID, matchers, silence.StartsAt, silence.EndsAt,
+		silence.Author, silence.Comment, silence.CreatedAt)
+	return err
+}
+
+func (s *Storage) GetSilence(ctx context.Context, id string) (storage.Silence, error) {
+	q := `
+        SELECT id, matchers, starts_at, ends_at, author, comment, created_at
+        FROM "public".silences
+        WHERE id=$1
+        `
+	silence, err := scanSilence(s.QueryRow(ctx, q, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return storage.Silence{}, storage.ErrSilenceNotFound
+	}
+	return silence, err
+}
+
+func (s *Storage) ListSilences(ctx context.Context) ([]storage.Silence, error) {
+	q := `
+        SELECT id, matchers, starts_at, ends_at, author, comment, created_at
+        FROM "public".silences
+        ORDER BY created_at
+        `
+	rows, err := s.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []storage.Silence
+	for rows.Next() {
+		silence, err := scanSilence(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, silence)
+	}
+	return result, rows.Err()
+}
+
+func (s *Storage) DeleteSilence(ctx context.Context, id string) error {
+	tag, err := s.Exec(ctx, `DELETE FROM "public".silences WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return storage.ErrSilenceNotFound
+	}
+	return nil
+}
+
+func scanSilence(row pgx.Row) (storage.Silence, error) {
+	var r storage.Silence
+	var matchers []byte
+	if err := row.Scan(&r.ID, &matchers, &r.StartsAt, &r.EndsAt, &r.Author, &r.Comment, &r.CreatedAt); err != nil {
+		return storage.Silence{}, err
+	}
+	if err := json.Unmarshal(matchers, &r.Matchers); err != nil {
+		return storage.Silence{}, err
+	}
+	return r, nil
+}
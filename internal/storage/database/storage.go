@@ -2,50 +2,159 @@ package database
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/eugeniylennik/alertics/internal/database"
 	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"sort"
+	"time"
 )
 
 type Storage struct {
 	database.Client
 }
 
-type Repository interface {
-	SelectMetricById(ctx context.Context, m metrics.Metrics) (metrics.Metrics, error)
-	InsertMetrics(ctx context.Context, m metrics.Metrics) error
-	InsertMetricsStatement(ctx context.Context, m []metrics.Metrics) error
+const upsertQuery = `
+        INSERT INTO public."metrics" (id, type, labels, delta, value, histogram, hash)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (id, type, labels) DO UPDATE
+        SET delta = CASE
+                WHEN excluded.type = 'counter'
+                THEN metrics.delta + excluded.delta
+                ELSE excluded.delta
+            END,
+            value = excluded.value,
+            histogram = excluded.histogram,
+            hash = excluded.hash
+        RETURNING id, type, labels, delta, value, histogram`
+
+const insertSampleQuery = `
+        INSERT INTO public."metric_samples" (id, type, labels, ts, value)
+        VALUES ($1, $2, $3, $4, $5)`
+
+// querier is satisfied by both the connection pool and a transaction.
+type querier interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
 }
 
-func (s *Storage) SelectMetricById(ctx context.Context, m metrics.Metrics) (metrics.Metrics, error) {
+func (s *Storage) GetMetric(ctx context.Context, mType, id string, labels metrics.Labels) (metrics.Metrics, error) {
 	q := `
-        SELECT id, type, delta, value, hash 
+        SELECT id, type, labels, delta, value, histogram
         FROM "public".metrics
-        WHERE id=$1 AND type=$2
+        WHERE id=$1 AND type=$2 AND labels=$3
         `
-	var r metrics.Metrics
-	err := s.QueryRow(ctx, q, m.ID, m.MType).Scan(&r.ID, &r.MType, &r.Delta, &r.Value, &r.Hash)
+	l, err := marshalLabels(labels)
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+	r, err := scanMetric(s.QueryRow(ctx, q, id, mType, l))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return metrics.Metrics{}, storage.ErrNotFound
+	}
 	if err != nil {
 		return metrics.Metrics{}, err
 	}
 	return r, nil
 }
 
-func (s *Storage) InsertMetrics(ctx context.Context, m metrics.Metrics) error {
+func (s *Storage) UpsertMetric(ctx context.Context, m metrics.Metrics) (metrics.Metrics, error) {
+	if err := storage.Validate(m); err != nil {
+		return metrics.Metrics{}, err
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	r, err := upsert(ctx, tx, upsertQuery, m, time.Now())
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+	return r, tx.Commit(ctx)
+}
+
+func (s *Storage) UpsertMetrics(ctx context.Context, m []metrics.Metrics) ([]metrics.Metrics, error) {
+	for _, v := range m {
+		if err := storage.Validate(v); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := s.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Prepare(ctx, "upsert-metrics", upsertQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	result := make([]metrics.Metrics, 0, len(m))
+	for _, metric := range m {
+		r, err := upsert(ctx, tx, "upsert-metrics", metric, now)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+
+	return result, tx.Commit(ctx)
+}
+
+func (s *Storage) ListMetrics(ctx context.Context) ([]metrics.Metrics, error) {
 	q := `
-        INSERT INTO public."metrics" (id, type, delta, value, hash) 
-        VALUES ($1, $2, $3, $4, $5)
-        ON CONFLICT (id) DO UPDATE
-        SET type = excluded.type,
-            delta = excluded.delta,
-            value = excluded.value,
-            hash = excluded.hash`
-	if _, err := s.Exec(ctx, q, m.ID, m.MType, m.Delta, m.Value, m.Hash); err != nil {
-		return err
+        SELECT id, type, labels, delta, value, histogram
+        FROM "public".metrics
+        ORDER BY type, id
+        `
+	rows, err := s.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []metrics.Metrics
+	for rows.Next() {
+		r, err := scanMetric(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
 	}
-	return nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	// Series of the same metric are ordered by their canonical labels, which
+	// jsonb ordering does not follow.
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.MType != b.MType {
+			return a.MType < b.MType
+		}
+		if a.ID != b.ID {
+			return a.ID < b.ID
+		}
+		return a.Labels.String() < b.Labels.String()
+	})
+	return result, nil
 }
 
-func (s *Storage) InsertMetricsStatement(ctx context.Context, m []metrics.Metrics) error {
+func (s *Storage) DeleteMetric(ctx context.Context, mType, id string, labels metrics.Labels) error {
+	l, err := marshalLabels(labels)
+	if err != nil {
+		return err
+	}
+
 	tx, err := s.Begin(ctx)
 	if err != nil {
 		return err
@@ -53,31 +162,148 @@ func (s *Storage) InsertMetricsStatement(ctx context.Context, m []metrics.Metric
 	defer tx.Rollback(ctx)
 
 	q := `
-		INSERT INTO public."metrics" (id, type, delta, value, hash) 
-		VALUES ($1, $2, $3, $4, $5)
-		ON CONFLICT (id) DO UPDATE
-		SET type = excluded.type,
-			delta = excluded.delta,
-			value = excluded.value,
-			hash = excluded.hash`
-
-	_, err = tx.Prepare(ctx, "insert-metrics", q)
+        DELETE FROM "public".metrics
+        WHERE id=$1 AND type=$2 AND labels=$3
+        `
+	tag, err := tx.Exec(ctx, q, id, mType, l)
 	if err != nil {
 		return err
 	}
+	if tag.RowsAffected() == 0 {
+		return storage.ErrNotFound
+	}
 
-	for _, metric := range m {
-		_, err = tx.Exec(context.Background(), "insert-metrics",
-			metric.ID, metric.MType, metric.Delta, metric.Value, metric.Hash)
-		if err != nil {
+	for _, q := range []string{
+		`DELETE FROM "public".metric_samples WHERE id=$1 AND type=$2 AND labels=$3`,
+		`DELETE FROM "public".metric_rollups WHERE id=$1 AND type=$2 AND labels=$3`,
+	} {
+		if _, err := tx.Exec(ctx, q, id, mType, l); err != nil {
 			return err
 		}
 	}
-
 	return tx.Commit(ctx)
 }
 
-func NewStorage(client database.Client) Repository {
+func (s *Storage) QueryRange(ctx context.Context, mType, id string, labels metrics.Labels, from, to time.Time) ([]storage.Sample, error) {
+	if _, err := s.GetMetric(ctx, mType, id, labels); err != nil {
+		return nil, err
+	}
+	l, err := marshalLabels(labels)
+	if err != nil {
+		return nil, err
+	}
+
+	q := `
+        SELECT ts, value
+        FROM "public".metric_samples
+        WHERE id=$1 AND type=$2 AND labels=$3 AND ts BETWEEN $4 AND $5
+        ORDER BY ts
+        `
+	rows, err := s.Query(ctx, q, id, mType, l, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []storage.Sample
+	for rows.Next() {
+		var r storage.Sample
+		if err := rows.Scan(&r.Timestamp, &r.Value); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// upsert stores m and appends the resulting value to the series history.
+func upsert(ctx context.Context, q querier, sql string, m metrics.Metrics, ts time.Time) (metrics.Metrics, error) {
+	l, err := marshalLabels(m.Labels)
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+	h, err := mergeHistogram(ctx, q, m, l)
+	if err != nil {
+		return metrics.Metrics{}, fmt.Errorf("metric %s: %w", m.ID, err)
+	}
+	r, err := scanMetric(q.QueryRow(ctx, sql, m.ID, m.MType, l, m.Delta, m.Value, h, m.Hash))
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+
+	sample := storage.NewSample(ts, r)
+	if _, err := q.Exec(ctx, insertSampleQuery, r.ID, r.MType, l, sample.Timestamp, sample.Value); err != nil {
+		return metrics.Metrics{}, err
+	}
+	return r, nil
+}
+
+// scanMetric reads a row of id, type, labels, delta, value and histogram.
+func scanMetric(row pgx.Row) (metrics.Metrics, error) {
+	var r metrics.Metrics
+	var labels, histogram []byte
+	if err := row.Scan(&r.ID, &r.MType, &labels, &r.Delta, &r.Value, &histogram); err != nil {
+		return metrics.Metrics{}, err
+	}
+	if err := json.Unmarshal(labels, &r.Labels); err != nil {
+		return metrics.Metrics{}, err
+	}
+	if len(r.Labels) == 0 {
+		r.Labels = nil
+	}
+	if histogram != nil {
+		if err := json.Unmarshal(histogram, &r.Histogram); err != nil {
+			return metrics.Metrics{}, err
+		}
+	}
+	return r, nil
+}
+
+// mergeHistogram returns the JSON of the histogram of m merged into the
+// stored one, or nil for other types. It must run in a transaction: the
+// series is guarded by an advisory lock held until the transaction ends, so
+// concurrent updates are merged one after another even while the row does
+// not exist yet.
+func mergeHistogram(ctx context.Context, q querier, m metrics.Metrics, labels []byte) (interface{}, error) {
+	if m.MType != storage.Histogram {
+		return nil, nil
+	}
+	key := m.ID + "/" + m.MType + "/" + string(labels)
+	if _, err := q.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1::text))`, key); err != nil {
+		return nil, err
+	}
+	h := m.Histogram
+	var prev []byte
+	err := q.QueryRow(ctx, `
+        SELECT histogram
+        FROM "public".metrics
+        WHERE id=$1 AND type=$2 AND labels=$3`, m.ID, m.MType, labels).Scan(&prev)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	if prev != nil {
+		var stored metrics.Histogram
+		if err := json.Unmarshal(prev, &stored); err != nil {
+			return nil, err
+		}
+		if h, err = stored.Merge(h); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(h)
+}
+
+// marshalLabels encodes labels for the jsonb labels column; a series without
+// labels is stored as an empty object so it still takes part in the unique
+// index.
+func marshalLabels(labels metrics.Labels) ([]byte, error) {
+	if len(labels) == 0 {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(labels)
+}
+
+func NewStorage(client database.Client) *Storage {
 	return &Storage{
 		client,
 	}
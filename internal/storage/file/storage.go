@@ -2,12 +2,27 @@ package file
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
 	"os"
+	"sync"
 )
 
+// Storage keeps metrics and silences in memory and dumps them to a file,
+// either on every write when syncWrite is set or whenever Flush is called.
+// The file holds the metrics document on the first line and the silences on
+// the second one.
+type Storage struct {
+	*storage.MemStorage
+	mux       sync.Mutex
+	fileName  string
+	syncWrite bool
+	writer    *Writer
+}
+
 type Writer struct {
 	file *os.File
 }
@@ -88,9 +103,168 @@ func (r *Reader) ReadMetrics() ([]metrics.Data, error) {
 		})
 	}
 
+	var h struct {
+		Histogram map[string]*metrics.Histogram
+	}
+	if err := json.Unmarshal(mBz, &h); err != nil {
+		return nil, err
+	}
+	for name, value := range h.Histogram {
+		data = append(data, metrics.Data{
+			Name:      name,
+			Type:      "histogram",
+			Histogram: value,
+		})
+	}
+
 	return data, err
 }
 
+// ReadSilences reads the silences following the metrics. Files written
+// before silences were stored have none.
+func (r *Reader) ReadSilences() ([]storage.Silence, error) {
+	if !r.scanner.Scan() {
+		return nil, r.scanner.Err()
+	}
+	var silences []storage.Silence
+	if err := json.Unmarshal(r.scanner.Bytes(), &silences); err != nil {
+		return nil, err
+	}
+	return silences, nil
+}
+
 func (r *Reader) Close() error {
 	return r.file.Close()
 }
+
+func NewStorage(fileName string, syncWrite bool, historySize int) (*Storage, error) {
+	w, err := NewWriter(fileName)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{
+		MemStorage: storage.NewMemStorage(historySize),
+		fileName:   fileName,
+		syncWrite:  syncWrite,
+		writer:     w,
+	}, nil
+}
+
+func (s *Storage) UpsertMetric(ctx context.Context, m metrics.Metrics) (metrics.Metrics, error) {
+	r, err := s.MemStorage.UpsertMetric(ctx, m)
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+	return r, s.sync(ctx)
+}
+
+func (s *Storage) UpsertMetrics(ctx context.Context, m []metrics.Metrics) ([]metrics.Metrics, error) {
+	r, err := s.MemStorage.UpsertMetrics(ctx, m)
+	if err != nil {
+		return nil, err
+	}
+	return r, s.sync(ctx)
+}
+
+func (s *Storage) DeleteMetric(ctx context.Context, mType, id string, labels metrics.Labels) error {
+	if err := s.MemStorage.DeleteMetric(ctx, mType, id, labels); err != nil {
+		return err
+	}
+	return s.sync(ctx)
+}
+
+func (s *Storage) SaveSilence(ctx context.Context, silence storage.Silence) error {
+	if err := s.MemStorage.SaveSilence(ctx, silence); err != nil {
+		return err
+	}
+	return s.sync(ctx)
+}
+
+func (s *Storage) DeleteSilence(ctx context.Context, id string) error {
+	if err := s.MemStorage.DeleteSilence(ctx, id); err != nil {
+		return err
+	}
+	return s.sync(ctx)
+}
+
+// Flush writes the current state of the storage to the file.
+func (s *Storage) Flush(ctx context.Context) error {
+	m, err := s.ListMetrics(ctx)
+	if err != nil {
+		return err
+	}
+	b, err := storage.MarshalMetrics(m)
+	if err != nil {
+		return err
+	}
+	silences, err := s.ListSilences(ctx)
+	if err != nil {
+		return err
+	}
+	sb, err := json.Marshal(silences)
+	if err != nil {
+		return err
+	}
+	b = append(append(b, '\n'), sb...)
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.writer.WriteMetrics(b)
+}
+
+// Restore loads metrics and silences previously dumped to the file.
+func (s *Storage) Restore(ctx context.Context) error {
+	r, err := NewReader(s.fileName)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	data, err := r.ReadMetrics()
+	if err != nil {
+		return err
+	}
+
+	m := make([]metrics.Metrics, 0, len(data))
+	for _, v := range data {
+		v := v
+		id, labels, err := metrics.SplitSeries(v.Name)
+		if err != nil {
+			return err
+		}
+		switch v.Type {
+		case storage.Gauge:
+			m = append(m, metrics.Metrics{ID: id, MType: v.Type, Labels: labels, Value: &v.Value})
+		case storage.Counter:
+			d := int64(v.Value)
+			m = append(m, metrics.Metrics{ID: id, MType: v.Type, Labels: labels, Delta: &d})
+		case storage.Histogram:
+			m = append(m, metrics.Metrics{ID: id, MType: v.Type, Labels: labels, Histogram: v.Histogram})
+		}
+	}
+	if _, err := s.MemStorage.UpsertMetrics(ctx, m); err != nil {
+		return err
+	}
+
+	silences, err := r.ReadSilences()
+	if err != nil {
+		return err
+	}
+	for _, v := range silences {
+		if err := s.MemStorage.SaveSilence(ctx, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Storage) Close() error {
+	return s.writer.Close()
+}
+
+func (s *Storage) sync(ctx context.Context) error {
+	if !s.syncWrite {
+		return nil
+	}
+	return s.Flush(ctx)
+}
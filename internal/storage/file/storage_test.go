@@ -0,0 +1,52 @@
+package file_test
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/eugeniylennik/alertics/internal/storage/file"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage_FlushRestore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "metrics.json")
+
+	s, err := file.NewStorage(path, false, storage.DefaultHistorySize)
+	require.NoError(t, err)
+
+	value := 1.5
+	_, err = s.UpsertMetric(ctx, metrics.Metrics{ID: "Alloc", MType: storage.Gauge, Value: &value})
+	require.NoError(t, err)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	silence := storage.Silence{
+		ID:        storage.NewSilenceID(),
+		Matchers:  storage.Matchers{Metric: "Alloc", Labels: map[string]string{"host": "web-1"}},
+		StartsAt:  now,
+		EndsAt:    now.Add(time.Hour),
+		Author:    "oncall",
+		Comment:   "maintenance",
+		CreatedAt: now,
+	}
+	require.NoError(t, s.SaveSilence(ctx, silence))
+	require.NoError(t, s.Flush(ctx))
+	require.NoError(t, s.Close())
+
+	restored, err := file.NewStorage(path, false, storage.DefaultHistorySize)
+	require.NoError(t, err)
+	defer restored.Close()
+	require.NoError(t, restored.Restore(ctx))
+
+	m, err := restored.GetMetric(ctx, storage.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+
+	silences, err := restored.ListSilences(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []storage.Silence{silence}, silences)
+}
@@ -0,0 +1,126 @@
+package storage
+
+import (
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"time"
+)
+
+// DefaultSampleInterval is the default report interval of the agent, at which
+// HistorySize assumes series to be updated.
+const DefaultSampleInterval = 10 * time.Second
+
+// DefaultHistorySize is the number of samples kept per series in memory. It
+// covers the raw retention of DefaultRetention at DefaultSampleInterval.
+const DefaultHistorySize = 17280
+
+// HistorySize returns the number of samples per series that keeps raw samples
+// for retention at DefaultSampleInterval. Series updated more often lose
+// their oldest samples before they expire.
+func HistorySize(retention time.Duration) int {
+	return int(retention / DefaultSampleInterval)
+}
+
+// Sample is a value of a series at a point in time. Counter samples hold the
+// accumulated counter value after the update and histogram samples the
+// number of observations.
+type Sample struct {
+	Timestamp time.Time `json:"timestamp"`
+	Value     float64   `json:"value"`
+}
+
+func NewSample(ts time.Time, m metrics.Metrics) Sample {
+	s := Sample{Timestamp: ts}
+	switch {
+	case m.Value != nil:
+		s.Value = *m.Value
+	case m.Delta != nil:
+		s.Value = float64(*m.Delta)
+	case m.Histogram != nil:
+		s.Value = float64(m.Histogram.Count)
+	}
+	return s
+}
+
+// Downsample keeps the last sample of every step-wide bucket starting at from.
+// The samples must be sorted by time; a zero step returns them unchanged.
+func Downsample(samples []Sample, from time.Time, step time.Duration) []Sample {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+
+	var result []Sample
+	var bucket int64 = -1
+	for _, s := range samples {
+		b := int64(s.Timestamp.Sub(from) / step)
+		if b == bucket {
+			result[len(result)-1] = s
+			continue
+		}
+		bucket = b
+		result = append(result, s)
+	}
+	return result
+}
+
+// seriesKey identifies a series; labels hold the canonical form.
+type seriesKey struct {
+	mType  string
+	id     string
+	labels string
+}
+
+func newSeriesKey(mType, id string, labels metrics.Labels) seriesKey {
+	return seriesKey{mType: mType, id: id, labels: labels.String()}
+}
+
+// ring is a fixed size buffer that overwrites its oldest samples. It grows
+// up to its size as samples are pushed.
+type ring struct {
+	samples []Sample
+	size    int
+	next    int
+	full    bool
+}
+
+func newRing(size int) *ring {
+	return &ring{size: size}
+}
+
+func (r *ring) push(s Sample) {
+	if len(r.samples) < r.size {
+		r.samples = append(r.samples, s)
+	} else {
+		r.samples[r.next] = s
+	}
+	r.next = (r.next + 1) % r.size
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// between returns the samples within [from, to] in chronological order.
+func (r *ring) between(from, to time.Time) []Sample {
+	var ordered []Sample
+	if r.full {
+		ordered = append(ordered, r.samples[r.next:]...)
+	}
+	ordered = append(ordered, r.samples[:r.next]...)
+
+	var result []Sample
+	for _, s := range ordered {
+		if s.Timestamp.Before(from) || s.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// dropBefore discards the samples older than t.
+func (r *ring) dropBefore(t time.Time) {
+	kept := r.between(t, time.Unix(1<<62, 0))
+	r.samples, r.next, r.full = r.samples[:0], 0, false
+	for _, s := range kept {
+		r.push(s)
+	}
+}
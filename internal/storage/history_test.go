@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestMemStorage_QueryRange(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage(3)
+
+	start := time.Now()
+	for i := 1; i <= 5; i++ {
+		v := float64(i)
+		_, err := ms.UpsertMetric(ctx, metrics.Metrics{ID: "HeapAlloc", MType: Gauge, Value: &v})
+		require.NoError(t, err)
+	}
+
+	samples, err := ms.QueryRange(ctx, Gauge, "HeapAlloc", nil, start, time.Now())
+	require.NoError(t, err)
+	require.Len(t, samples, 3)
+	assert.Equal(t, []float64{3, 4, 5}, []float64{samples[0].Value, samples[1].Value, samples[2].Value})
+
+	_, err = ms.QueryRange(ctx, Gauge, "Unknown", nil, start, time.Now())
+	assert.ErrorIs(t, err, ErrNotFound)
+}
+
+func TestDownsample(t *testing.T) {
+	from := time.Unix(0, 0)
+	samples := []Sample{
+		{Timestamp: from.Add(10 * time.Second), Value: 1},
+		{Timestamp: from.Add(50 * time.Second), Value: 2},
+		{Timestamp: from.Add(70 * time.Second), Value: 3},
+		{Timestamp: from.Add(190 * time.Second), Value: 4},
+	}
+
+	result := Downsample(samples, from, time.Minute)
+	require.Len(t, result, 3)
+	assert.Equal(t, 2.0, result[0].Value)
+	assert.Equal(t, 3.0, result[1].Value)
+	assert.Equal(t, 4.0, result[2].Value)
+}
@@ -0,0 +1,319 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRetention keeps raw samples for 2 days, 1m rollups for 30 days and
+// 1h rollups for a year.
+const DefaultRetention = "raw:48h,1m:720h,1h:8760h"
+
+// RetentionPolicy describes how long raw samples are kept and which rollups
+// are built from them. Each rollup level is aggregated from the previous one,
+// so resolutions must be increasing.
+type RetentionPolicy struct {
+	Raw     time.Duration
+	Rollups []RollupPolicy
+}
+
+type RollupPolicy struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+// Rollup aggregates the samples of one series over a resolution-wide bucket
+// starting at Timestamp. For gauges Sum is the sum of the values; for
+// counters it is the increase of the counter within the bucket.
+type Rollup struct {
+	Timestamp time.Time `json:"timestamp"`
+	Count     int64     `json:"count"`
+	Min       float64   `json:"min"`
+	Max       float64   `json:"max"`
+	Sum       float64   `json:"sum"`
+	Last      float64   `json:"last"`
+}
+
+func (r Rollup) Avg() float64 {
+	if r.Count == 0 {
+		return 0
+	}
+	return r.Sum / float64(r.Count)
+}
+
+// Rate returns the per-second increase of a counter rollup.
+func (r Rollup) Rate(resolution time.Duration) float64 {
+	return r.Sum / resolution.Seconds()
+}
+
+// RollupStore is implemented by backends that support retention and
+// downsampling. A zero resolution in DeleteBefore refers to raw samples.
+type RollupStore interface {
+	Repository
+	QueryRollups(ctx context.Context, mType, id string, labels metrics.Labels, resolution time.Duration, from, to time.Time) ([]Rollup, error)
+	SaveRollups(ctx context.Context, mType, id string, labels metrics.Labels, resolution time.Duration, r []Rollup) error
+	DeleteBefore(ctx context.Context, resolution time.Duration, before time.Time) error
+}
+
+// ParseRetentionPolicy parses policies such as "raw:48h,1m:720h,1h:8760h".
+func ParseRetentionPolicy(s string) (RetentionPolicy, error) {
+	var p RetentionPolicy
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		res, ret, ok := strings.Cut(part, ":")
+		if !ok {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention %q", part)
+		}
+		retention, err := time.ParseDuration(ret)
+		if err != nil || retention <= 0 {
+			return RetentionPolicy{}, fmt.Errorf("invalid retention %q", part)
+		}
+		if res == "raw" {
+			p.Raw = retention
+			continue
+		}
+		resolution, err := time.ParseDuration(res)
+		if err != nil || resolution <= 0 {
+			return RetentionPolicy{}, fmt.Errorf("invalid resolution %q", part)
+		}
+		p.Rollups = append(p.Rollups, RollupPolicy{Resolution: resolution, Retention: retention})
+	}
+	if p.Raw == 0 {
+		return RetentionPolicy{}, fmt.Errorf("retention %q has no raw entry", s)
+	}
+
+	sort.Slice(p.Rollups, func(i, j int) bool {
+		return p.Rollups[i].Resolution < p.Rollups[j].Resolution
+	})
+	return p, nil
+}
+
+// Compactor builds rollups for every complete bucket whose source data is
+// still retained and drops raw samples and rollups past their retention. It
+// remembers per series and resolution up to where rollups were built, so each
+// run only aggregates new buckets; after a restart the retained window is
+// aggregated once more.
+type Compactor struct {
+	store  RollupStore
+	policy RetentionPolicy
+
+	mux        sync.Mutex
+	watermarks map[rollupKey]time.Time
+}
+
+func NewCompactor(s RollupStore, p RetentionPolicy) *Compactor {
+	return &Compactor{store: s, policy: p, watermarks: map[rollupKey]time.Time{}}
+}
+
+func (c *Compactor) Compact(ctx context.Context, now time.Time) error {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	series, err := c.store.ListMetrics(ctx)
+	if err != nil {
+		return err
+	}
+
+	seen := map[seriesKey]bool{}
+	for _, m := range series {
+		seen[newSeriesKey(m.MType, m.ID, m.Labels)] = true
+		if err := c.compactSeries(ctx, m, now); err != nil {
+			return err
+		}
+	}
+	for key := range c.watermarks {
+		if !seen[key.seriesKey] {
+			delete(c.watermarks, key)
+		}
+	}
+
+	if err := c.store.DeleteBefore(ctx, 0, now.Add(-c.policy.Raw)); err != nil {
+		return err
+	}
+	for _, rp := range c.policy.Rollups {
+		if err := c.store.DeleteBefore(ctx, rp.Resolution, now.Add(-rp.Retention)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactSeries builds the new rollups of one series level by level. A level
+// is only built up to where its source level is complete.
+func (c *Compactor) compactSeries(ctx context.Context, m metrics.Metrics, now time.Time) error {
+	var srcResolution time.Duration
+	srcRetention, srcEnd := c.policy.Raw, now
+	for _, rp := range c.policy.Rollups {
+		key := rollupKey{newSeriesKey(m.MType, m.ID, m.Labels), rp.Resolution}
+		retained := now.Add(-srcRetention)
+		start := retained.Truncate(rp.Resolution)
+		if start.Before(retained) {
+			start = start.Add(rp.Resolution)
+		}
+		if watermark := c.watermarks[key]; start.Before(watermark) {
+			start = watermark
+		}
+		end := srcEnd.Truncate(rp.Resolution)
+
+		if start.Before(end) {
+			var src []Rollup
+			if srcResolution == 0 {
+				// The samples of the previous bucket are the baseline of
+				// counter increases.
+				from := start.Add(-rp.Resolution)
+				if from.Before(retained) {
+					from = retained
+				}
+				samples, err := c.store.QueryRange(ctx, m.MType, m.ID, m.Labels, from, end)
+				if err != nil {
+					return err
+				}
+				src = SamplesToRollups(m.MType, samples)
+			} else {
+				var err error
+				src, err = c.store.QueryRollups(ctx, m.MType, m.ID, m.Labels, srcResolution, start, end)
+				if err != nil {
+					return err
+				}
+			}
+
+			var result []Rollup
+			for _, r := range Aggregate(src, rp.Resolution) {
+				if !r.Timestamp.Before(start) && r.Timestamp.Before(end) {
+					result = append(result, r)
+				}
+			}
+			if len(result) > 0 {
+				if err := c.store.SaveRollups(ctx, m.MType, m.ID, m.Labels, rp.Resolution, result); err != nil {
+					return err
+				}
+			}
+			c.watermarks[key] = end
+		}
+
+		srcResolution, srcRetention, srcEnd = rp.Resolution, rp.Retention, end
+	}
+	return nil
+}
+
+// SamplesToRollups turns raw samples into single-sample rollups. Counter and
+// histogram samples hold accumulated values, so their increase is the
+// difference to the previous sample and a drop in value is treated as a
+// counter reset. The first sample has no previous one and only serves as a
+// baseline, so callers include the last samples before the range they
+// aggregate.
+func SamplesToRollups(mType string, samples []Sample) []Rollup {
+	result := make([]Rollup, 0, len(samples))
+	for i, s := range samples {
+		r := Rollup{Timestamp: s.Timestamp, Count: 1, Min: s.Value, Max: s.Value, Sum: s.Value, Last: s.Value}
+		if mType == Counter || mType == Histogram {
+			switch {
+			case i == 0:
+				r.Sum = 0
+			case s.Value >= samples[i-1].Value:
+				r.Sum = s.Value - samples[i-1].Value
+			}
+		}
+		result = append(result, r)
+	}
+	return result
+}
+
+// Aggregate merges time-ordered rollups into resolution-wide buckets.
+func Aggregate(src []Rollup, resolution time.Duration) []Rollup {
+	var result []Rollup
+	for _, r := range src {
+		ts := r.Timestamp.Truncate(resolution)
+		if n := len(result); n > 0 && result[n-1].Timestamp.Equal(ts) {
+			b := &result[n-1]
+			b.Count += r.Count
+			b.Sum += r.Sum
+			b.Last = r.Last
+			if r.Min < b.Min {
+				b.Min = r.Min
+			}
+			if r.Max > b.Max {
+				b.Max = r.Max
+			}
+			continue
+		}
+		r.Timestamp = ts
+		result = append(result, r)
+	}
+	return result
+}
+
+type rollupKey struct {
+	seriesKey
+	resolution time.Duration
+}
+
+func (ms *MemStorage) QueryRollups(_ context.Context, mType, id string, labels metrics.Labels, resolution time.Duration, from, to time.Time) ([]Rollup, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+
+	key := newSeriesKey(mType, id, labels)
+	if _, err := ms.get(key); err != nil {
+		return nil, err
+	}
+
+	var result []Rollup
+	for _, r := range ms.rollups[rollupKey{key, resolution}] {
+		if r.Timestamp.Before(from) || r.Timestamp.After(to) {
+			continue
+		}
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Timestamp.Before(result[j].Timestamp)
+	})
+	return result, nil
+}
+
+func (ms *MemStorage) SaveRollups(_ context.Context, mType, id string, labels metrics.Labels, resolution time.Duration, r []Rollup) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	key := rollupKey{newSeriesKey(mType, id, labels), resolution}
+	buckets, ok := ms.rollups[key]
+	if !ok {
+		buckets = map[int64]Rollup{}
+		ms.rollups[key] = buckets
+	}
+	for _, v := range r {
+		buckets[v.Timestamp.UnixNano()] = v
+	}
+	return nil
+}
+
+func (ms *MemStorage) DeleteBefore(_ context.Context, resolution time.Duration, before time.Time) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+
+	if resolution == 0 {
+		for _, h := range ms.history {
+			h.dropBefore(before)
+		}
+		return nil
+	}
+
+	for key, buckets := range ms.rollups {
+		if key.resolution != resolution {
+			continue
+		}
+		for ts, r := range buckets {
+			if r.Timestamp.Before(before) {
+				delete(buckets, ts)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package storage
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestParseRetentionPolicy(t *testing.T) {
+	p, err := ParseRetentionPolicy("1h:8760h, raw:48h, 1m:720h")
+	require.NoError(t, err)
+	assert.Equal(t, 48*time.Hour, p.Raw)
+	assert.Equal(t, []RollupPolicy{
+		{Resolution: time.Minute, Retention: 720 * time.Hour},
+		{Resolution: time.Hour, Retention: 8760 * time.Hour},
+	}, p.Rollups)
+
+	_, err = ParseRetentionPolicy("1m:720h")
+	assert.Error(t, err)
+}
+
+func TestCompact(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage(DefaultHistorySize)
+
+	// Keep all samples within one minute bucket.
+	if d := time.Until(time.Now().Truncate(time.Minute).Add(time.Minute)); d < time.Second {
+		time.Sleep(d)
+	}
+
+	start := time.Now()
+	for _, v := range []float64{4, 1, 7} {
+		v := v
+		_, err := ms.UpsertMetric(ctx, metrics.Metrics{ID: "HeapAlloc", MType: Gauge, Value: &v})
+		require.NoError(t, err)
+	}
+	for i := 0; i < 3; i++ {
+		d := int64(1)
+		_, err := ms.UpsertMetric(ctx, metrics.Metrics{ID: "PollCount", MType: Counter, Delta: &d})
+		require.NoError(t, err)
+	}
+
+	policy, err := ParseRetentionPolicy("raw:1h,1m:24h")
+	require.NoError(t, err)
+	require.NoError(t, NewCompactor(ms, policy).Compact(ctx, start.Add(2*time.Minute)))
+
+	bucket := start.Truncate(time.Minute)
+	gauge, err := ms.QueryRollups(ctx, Gauge, "HeapAlloc", nil, time.Minute, bucket, bucket.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, gauge, 1)
+	assert.Equal(t, Rollup{Timestamp: bucket, Count: 3, Min: 1, Max: 7, Sum: 12, Last: 7}, gauge[0])
+	assert.Equal(t, 4.0, gauge[0].Avg())
+
+	counter, err := ms.QueryRollups(ctx, Counter, "PollCount", nil, time.Minute, bucket, bucket.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, counter, 1)
+	assert.Equal(t, 2.0, counter[0].Sum)
+
+	require.NoError(t, NewCompactor(ms, policy).Compact(ctx, start.Add(2*time.Hour)))
+	samples, err := ms.QueryRange(ctx, Gauge, "HeapAlloc", nil, start, start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+}
+
+func TestCompactor_Incremental(t *testing.T) {
+	ctx := context.Background()
+	ms := NewMemStorage(DefaultHistorySize)
+	d := int64(1)
+	_, err := ms.UpsertMetric(ctx, metrics.Metrics{ID: "PollCount", MType: Counter, Delta: &d})
+	require.NoError(t, err)
+
+	bucket := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	h := newRing(DefaultHistorySize)
+	for _, s := range []Sample{{bucket.Add(10 * time.Second), 1}, {bucket.Add(50 * time.Second), 3}} {
+		h.push(s)
+	}
+	ms.history[newSeriesKey(Counter, "PollCount", nil)] = h
+
+	policy, err := ParseRetentionPolicy("raw:1h,1m:24h")
+	require.NoError(t, err)
+	c := NewCompactor(ms, policy)
+	require.NoError(t, c.Compact(ctx, bucket.Add(65*time.Second)))
+
+	for _, s := range []Sample{{bucket.Add(70 * time.Second), 4}, {bucket.Add(110 * time.Second), 6}} {
+		h.push(s)
+	}
+	require.NoError(t, c.Compact(ctx, bucket.Add(125*time.Second)))
+
+	// The increase of the second bucket starts at the last sample of the
+	// first one.
+	rollups, err := ms.QueryRollups(ctx, Counter, "PollCount", nil, time.Minute, bucket, bucket.Add(time.Minute))
+	require.NoError(t, err)
+	require.Len(t, rollups, 2)
+	assert.Equal(t, 2.0, rollups[0].Sum)
+	assert.Equal(t, 3.0, rollups[1].Sum)
+
+	// Buckets that were built are not aggregated again.
+	marker := Rollup{Timestamp: bucket, Count: 1, Sum: 42}
+	require.NoError(t, ms.SaveRollups(ctx, Counter, "PollCount", nil, time.Minute, []Rollup{marker}))
+	require.NoError(t, c.Compact(ctx, bucket.Add(185*time.Second)))
+	rollups, err = ms.QueryRollups(ctx, Counter, "PollCount", nil, time.Minute, bucket, bucket)
+	require.NoError(t, err)
+	assert.Equal(t, []Rollup{marker}, rollups)
+}
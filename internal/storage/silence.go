@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"time"
+)
+
+var ErrSilenceNotFound = errors.New("silence not found")
+
+// Matchers select the alerts a silence applies to. Empty fields match any
+// value and all labels must be equal.
+type Matchers struct {
+	Metric string            `json:"metric,omitempty"`
+	MType  string            `json:"type,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type Silence struct {
+	ID        string    `json:"id"`
+	Matchers  Matchers  `json:"matchers"`
+	StartsAt  time.Time `json:"starts_at"`
+	EndsAt    time.Time `json:"ends_at"`
+	Author    string    `json:"author"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Active reports whether the silence is in effect at t.
+func (s Silence) Active(t time.Time) bool {
+	return !t.Before(s.StartsAt) && t.Before(s.EndsAt)
+}
+
+// SilenceRepository is implemented by backends that can store silences.
+type SilenceRepository interface {
+	SaveSilence(ctx context.Context, s Silence) error
+	GetSilence(ctx context.Context, id string) (Silence, error)
+	ListSilences(ctx context.Context) ([]Silence, error)
+	DeleteSilence(ctx context.Context, id string) error
+}
+
+func NewSilenceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func (ms *MemStorage) SaveSilence(_ context.Context, s Silence) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	ms.silences[s.ID] = s
+	return nil
+}
+
+func (ms *MemStorage) GetSilence(_ context.Context, id string) (Silence, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	s, ok := ms.silences[id]
+	if !ok {
+		return Silence{}, ErrSilenceNotFound
+	}
+	return s, nil
+}
+
+func (ms *MemStorage) ListSilences(_ context.Context) ([]Silence, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+
+	result := make([]Silence, 0, len(ms.silences))
+	for _, s := range ms.silences {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].CreatedAt.Before(result[j].CreatedAt)
+	})
+	return result, nil
+}
+
+func (ms *MemStorage) DeleteSilence(_ context.Context, id string) error {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	if _, ok := ms.silences[id]; !ok {
+		return ErrSilenceNotFound
+	}
+	delete(ms.silences, id)
+	return nil
+}
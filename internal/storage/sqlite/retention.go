@@ -0,0 +1,85 @@
+package sqlite
+
+import (
+	"context"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"time"
+)
+
+// Rollup timestamps are stored as unix nanoseconds and resolutions in
+// seconds.
+func (s *Storage) QueryRollups(ctx context.Context, mType, id string, labels metrics.Labels, resolution time.Duration, from, to time.Time) ([]storage.Rollup, error) {
+	if _, err := s.GetMetric(ctx, mType, id, labels); err != nil {
+		return nil, err
+	}
+
+	q := `
+        SELECT ts, count, min, max, sum, last
+        FROM metric_rollups
+        WHERE id=$1 AND type=$2 AND labels=$3 AND resolution=$4 AND ts BETWEEN $5 AND $6
+        ORDER BY ts
+        `
+	rows, err := s.QueryContext(ctx, q, id, mType, labels.String(), int64(resolution.Seconds()), from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []storage.Rollup
+	for rows.Next() {
+		var ts int64
+		var r storage.Rollup
+		if err := rows.Scan(&ts, &r.Count, &r.Min, &r.Max, &r.Sum, &r.Last); err != nil {
+			return nil, err
+		}
+		r.Timestamp = time.Unix(0, ts)
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+func (s *Storage) SaveRollups(ctx context.Context, mType, id string, labels metrics.Labels, resolution time.Duration, r []storage.Rollup) error {
+	tx, err := s.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+        INSERT INTO metric_rollups (id, type, labels, resolution, ts, count, min, max, sum, last)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+        ON CONFLICT (id, type, labels, resolution, ts) DO UPDATE
+        SET count = excluded.count,
+            min = excluded.min,
+            max = excluded.max,
+            sum = excluded.sum,
+            last = excluded.last`
+
+	stmt, err := tx.PrepareContext(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	l := labels.String()
+	for _, v := range r {
+		_, err = stmt.ExecContext(ctx,
+			id, mType, l, int64(resolution.Seconds()), v.Timestamp.UnixNano(), v.Count, v.Min, v.Max, v.Sum, v.Last)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *Storage) DeleteBefore(ctx context.Context, resolution time.Duration, before time.Time) error {
+	if resolution == 0 {
+		_, err := s.ExecContext(ctx, `DELETE FROM metric_samples WHERE ts < $1`, before.UnixNano())
+		return err
+	}
+	_, err := s.ExecContext(ctx, `DELETE FROM metric_rollups WHERE resolution=$1 AND ts < $2`,
+		int64(resolution.Seconds()), before.UnixNano())
+	return err
+}
@@ -0,0 +1,99 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"time"
+)
+
+func (s *Storage) SaveSilence(ctx context.Context, silence storage.Silence) error {
+	matchers, err := json.Marshal(silence.Matchers)
+	if err != nil {
+		return err
+	}
+	q := `
+        INSERT INTO silences (id, matchers, starts_at, ends_at, author, comment, created_at)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (id) DO UPDATE
+        SET matchers = excluded.matchers,
+            starts_at = excluded.starts_at,
+            ends_at = excluded.ends_at,
+            author = excluded.author,
+            comment = excluded.comment`
+	_, err = s.ExecContext(ctx, q, silence.ID, string(matchers), silence.StartsAt.UnixNano(),
+		silence.EndsAt.UnixNano(), silence.Author, silence.Comment, silence.CreatedAt.UnixNano())
+	return err
+}
+
+func (s *Storage) GetSilence(ctx context.Context, id string) (storage.Silence, error) {
+	q := `
+        SELECT id, matchers, starts_at, ends_at, author, comment, created_at
+        FROM silences
+        WHERE id=$1
+        `
+	silence, err := scanSilence(s.QueryRowContext(ctx, q, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return storage.Silence{}, storage.ErrSilenceNotFound
+	}
+	return silence, err
+}
+
+func (s *Storage) ListSilences(ctx context.Context) ([]storage.Silence, error) {
+	q := `
+        SELECT id, matchers, starts_at, ends_at, author, comment, created_at
+        FROM silences
+        ORDER BY created_at
+        `
+	rows, err := s.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []storage.Silence
+	for rows.Next() {
+		silence, err := scanSilence(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, silence)
+	}
+	return result, rows.Err()
+}
+
+func (s *Storage) DeleteSilence(ctx context.Context, id string) error {
+	res, err := s.ExecContext(ctx, `DELETE FROM silences WHERE id=$1`, id)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrSilenceNotFound
+	}
+	return nil
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanSilence reads a silence whose timestamps are stored as unix nanoseconds.
+func scanSilence(row scanner) (storage.Silence, error) {
+	var r storage.Silence
+	var matchers string
+	var startsAt, endsAt, createdAt int64
+	if err := row.Scan(&r.ID, &matchers, &startsAt, &endsAt, &r.Author, &r.Comment, &createdAt); err != nil {
+		return storage.Silence{}, err
+	}
+	if err := json.Unmarshal([]byte(matchers), &r.Matchers); err != nil {
+		return storage.Silence{}, err
+	}
+	r.StartsAt, r.EndsAt, r.CreatedAt = time.Unix(0, startsAt), time.Unix(0, endsAt), time.Unix(0, createdAt)
+	return r, nil
+}
@@ -0,0 +1,264 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"time"
+)
+
+type Storage struct {
+	*sql.DB
+}
+
+const upsertQuery = `
+        INSERT INTO metrics (id, type, labels, delta, value, histogram, hash)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        ON CONFLICT (id, type, labels) DO UPDATE
+        SET delta = CASE
+                WHEN excluded.type = 'counter'
+                THEN metrics.delta + excluded.delta
+                ELSE excluded.delta
+            END,
+            value = excluded.value,
+            histogram = excluded.histogram,
+            hash = excluded.hash
+        RETURNING id, type, labels, delta, value, histogram`
+
+// Sample timestamps are stored as unix nanoseconds.
+const insertSampleQuery = `
+        INSERT INTO metric_samples (id, type, labels, ts, value)
+        VALUES ($1, $2, $3, $4, $5)`
+
+func (s *Storage) GetMetric(ctx context.Context, mType, id string, labels metrics.Labels) (metrics.Metrics, error) {
+	q := `
+        SELECT id, type, labels, delta, value, histogram
+        FROM metrics
+        WHERE id=$1 AND type=$2 AND labels=$3
+        `
+	r, err := scanMetric(s.QueryRowContext(ctx, q, id, mType, labels.String()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return metrics.Metrics{}, storage.ErrNotFound
+	}
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+	return r, nil
+}
+
+func (s *Storage) UpsertMetric(ctx context.Context, m metrics.Metrics) (metrics.Metrics, error) {
+	if err := storage.Validate(m); err != nil {
+		return metrics.Metrics{}, err
+	}
+	r, err := s.UpsertMetrics(ctx, []metrics.Metrics{m})
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+	return r[0], nil
+}
+
+func (s *Storage) UpsertMetrics(ctx context.Context, m []metrics.Metrics) ([]metrics.Metrics, error) {
+	for _, v := range m {
+		if err := storage.Validate(v); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := s.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, upsertQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	sampleStmt, err := tx.PrepareContext(ctx, insertSampleQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer sampleStmt.Close()
+
+	now := time.Now()
+	result := make([]metrics.Metrics, 0, len(m))
+	for _, metric := range m {
+		labels := metric.Labels.String()
+		histogram, err := mergeHistogram(ctx, tx, metric, labels)
+		if err != nil {
+			return nil, fmt.Errorf("metric %s: %w", metric.ID, err)
+		}
+		r, err := scanMetric(stmt.QueryRowContext(ctx,
+			metric.ID, metric.MType, labels, metric.Delta, metric.Value, histogram, metric.Hash))
+		if err != nil {
+			return nil, err
+		}
+
+		sample := storage.NewSample(now, r)
+		if _, err := sampleStmt.ExecContext(ctx, r.ID, r.MType, labels, sample.Timestamp.UnixNano(), sample.Value); err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+
+	return result, tx.Commit()
+}
+
+func (s *Storage) ListMetrics(ctx context.Context) ([]metrics.Metrics, error) {
+	q := `
+        SELECT id, type, labels, delta, value, histogram
+        FROM metrics
+        ORDER BY type, id, labels
+        `
+	rows, err := s.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []metrics.Metrics
+	for rows.Next() {
+		r, err := scanMetric(rows)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+func (s *Storage) DeleteMetric(ctx context.Context, mType, id string, labels metrics.Labels) error {
+	tx, err := s.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	q := `
+        DELETE FROM metrics
+        WHERE id=$1 AND type=$2 AND labels=$3
+        `
+	res, err := tx.ExecContext(ctx, q, id, mType, labels.String())
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return storage.ErrNotFound
+	}
+
+	for _, q := range []string{
+		`DELETE FROM metric_samples WHERE id=$1 AND type=$2 AND labels=$3`,
+		`DELETE FROM metric_rollups WHERE id=$1 AND type=$2 AND labels=$3`,
+	} {
+		if _, err := tx.ExecContext(ctx, q, id, mType, labels.String()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *Storage) QueryRange(ctx context.Context, mType, id string, labels metrics.Labels, from, to time.Time) ([]storage.Sample, error) {
+	if _, err := s.GetMetric(ctx, mType, id, labels); err != nil {
+		return nil, err
+	}
+
+	q := `
+        SELECT ts, value
+        FROM metric_samples
+        WHERE id=$1 AND type=$2 AND labels=$3 AND ts BETWEEN $4 AND $5
+        ORDER BY ts
+        `
+	rows, err := s.QueryContext(ctx, q, id, mType, labels.String(), from.UnixNano(), to.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []storage.Sample
+	for rows.Next() {
+		var ts int64
+		var r storage.Sample
+		if err := rows.Scan(&ts, &r.Value); err != nil {
+			return nil, err
+		}
+		r.Timestamp = time.Unix(0, ts)
+		result = append(result, r)
+	}
+	return result, rows.Err()
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanMetric reads a row of id, type, canonical labels, delta, value and
+// histogram.
+func scanMetric(row rowScanner) (metrics.Metrics, error) {
+	var r metrics.Metrics
+	var labels string
+	var histogram sql.NullString
+	if err := row.Scan(&r.ID, &r.MType, &labels, &r.Delta, &r.Value, &histogram); err != nil {
+		return metrics.Metrics{}, err
+	}
+	l, err := metrics.ParseLabels(labels)
+	if err != nil {
+		return metrics.Metrics{}, err
+	}
+	r.Labels = l
+	if histogram.Valid {
+		if err := json.Unmarshal([]byte(histogram.String), &r.Histogram); err != nil {
+			return metrics.Metrics{}, err
+		}
+	}
+	return r, nil
+}
+
+// mergeHistogram returns the JSON of the histogram of m merged into the
+// stored one, or nil for other types.
+func mergeHistogram(ctx context.Context, tx *sql.Tx, m metrics.Metrics, labels string) (interface{}, error) {
+	if m.MType != storage.Histogram {
+		return nil, nil
+	}
+	h := m.Histogram
+	var prev sql.NullString
+	err := tx.QueryRowContext(ctx, `SELECT histogram FROM metrics WHERE id=$1 AND type=$2 AND labels=$3`,
+		m.ID, m.MType, labels).Scan(&prev)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	if prev.Valid {
+		var stored metrics.Histogram
+		if err := json.Unmarshal([]byte(prev.String), &stored); err != nil {
+			return nil, err
+		}
+		if h, err = stored.Merge(h); err != nil {
+			return nil, err
+		}
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+	return string(b), nil
+}
+
+func (s *Storage) Ping(ctx context.Context) error {
+	return s.PingContext(ctx)
+}
+
+func NewStorage(db *sql.DB) *Storage {
+	return &Storage{
+		db,
+	}
+}
@@ -0,0 +1,181 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"github.com/eugeniylennik/alertics/internal/database"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/eugeniylennik/alertics/internal/storage/sqlite"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage_UpsertMetrics(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.NewSQLiteClient(ctx, "sqlite://"+filepath.Join(t.TempDir(), "alertics.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	s := sqlite.NewStorage(db)
+	start := time.Now()
+
+	delta := int64(2)
+	value := 1.5
+	_, err = s.UpsertMetrics(ctx, []metrics.Metrics{
+		{ID: "PollCount", MType: storage.Counter, Delta: &delta},
+		{ID: "PollCount", MType: storage.Counter, Delta: &delta},
+		{ID: "Alloc", MType: storage.Gauge, Value: &value},
+	})
+	require.NoError(t, err)
+
+	m, err := s.UpsertMetric(ctx, metrics.Metrics{ID: "PollCount", MType: storage.Counter, Delta: &delta})
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), *m.Delta)
+
+	m, err = s.GetMetric(ctx, storage.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+
+	samples, err := s.QueryRange(ctx, storage.Counter, "PollCount", nil, start, time.Now())
+	require.NoError(t, err)
+	require.Len(t, samples, 3)
+	assert.Equal(t, 6.0, samples[2].Value)
+
+	all, err := s.ListMetrics(ctx)
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+
+	require.NoError(t, s.DeleteMetric(ctx, storage.Gauge, "Alloc", nil))
+	_, err = s.GetMetric(ctx, storage.Gauge, "Alloc", nil)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
+
+func TestStorage_Labels(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "alertics.db")
+
+	// A database created before series had labels.
+	old, err := sql.Open("sqlite3", path)
+	require.NoError(t, err)
+	_, err = old.Exec(`
+        CREATE TABLE metrics (id TEXT PRIMARY KEY, type TEXT NOT NULL, delta BIGINT, value DOUBLE PRECISION, hash TEXT);
+        CREATE TABLE metric_samples (id TEXT NOT NULL, type TEXT NOT NULL, ts INTEGER NOT NULL, value DOUBLE PRECISION NOT NULL);
+        CREATE INDEX metric_samples_series_idx ON metric_samples (id, type, ts);
+        INSERT INTO metrics (id, type, value) VALUES ('Alloc', 'gauge', 1.5);
+    `)
+	require.NoError(t, err)
+	require.NoError(t, old.Close())
+
+	db, err := database.NewSQLiteClient(ctx, "sqlite://"+path)
+	require.NoError(t, err)
+	defer db.Close()
+
+	s := sqlite.NewStorage(db)
+	start := time.Now()
+
+	value := 2.5
+	labels := metrics.Labels{"host": "web-1"}
+	_, err = s.UpsertMetric(ctx, metrics.Metrics{ID: "Alloc", MType: storage.Gauge, Labels: labels, Value: &value})
+	require.NoError(t, err)
+
+	m, err := s.GetMetric(ctx, storage.Gauge, "Alloc", nil)
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, *m.Value)
+
+	m, err = s.GetMetric(ctx, storage.Gauge, "Alloc", labels)
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, *m.Value)
+	assert.Equal(t, labels, m.Labels)
+
+	samples, err := s.QueryRange(ctx, storage.Gauge, "Alloc", labels, start, time.Now())
+	require.NoError(t, err)
+	assert.Len(t, samples, 1)
+
+	all, err := s.ListMetrics(ctx)
+	require.NoError(t, err)
+	require.Len(t, all, 2)
+	assert.Nil(t, all[0].Labels)
+	assert.Equal(t, labels, all[1].Labels)
+
+	// The samples index of unlabeled series is replaced.
+	var indexes []string
+	rows, err := db.QueryContext(ctx, `SELECT name FROM sqlite_master WHERE type='index' AND tbl_name='metric_samples'`)
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		indexes = append(indexes, name)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"metric_samples_series_labels_idx"}, indexes)
+}
+
+func TestStorage_Histogram(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.NewSQLiteClient(ctx, "sqlite://"+filepath.Join(t.TempDir(), "alertics.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	s := sqlite.NewStorage(db)
+
+	h := metrics.NewHistogram([]float64{1, 2})
+	h.Observe(0.5)
+	_, err = s.UpsertMetrics(ctx, []metrics.Metrics{
+		{ID: "Latency", MType: storage.Histogram, Histogram: h},
+		{ID: "Latency", MType: storage.Histogram, Histogram: h},
+	})
+	require.NoError(t, err)
+
+	m, err := s.GetMetric(ctx, storage.Histogram, "Latency", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []uint64{2, 2}, m.Histogram.Counts)
+	assert.Equal(t, uint64(2), m.Histogram.Count)
+
+	_, err = s.UpsertMetric(ctx, metrics.Metrics{ID: "Latency", MType: storage.Histogram, Histogram: metrics.NewHistogram([]float64{1})})
+	assert.ErrorIs(t, err, metrics.ErrBucketsMismatch)
+}
+
+func TestStorage_Retention(t *testing.T) {
+	ctx := context.Background()
+	db, err := database.NewSQLiteClient(ctx, "sqlite://"+filepath.Join(t.TempDir(), "alertics.db"))
+	require.NoError(t, err)
+	defer db.Close()
+
+	s := sqlite.NewStorage(db)
+	var _ storage.RollupStore = s
+
+	start := time.Now()
+	for _, v := range []float64{1, 3, 2} {
+		value := v
+		_, err := s.UpsertMetric(ctx, metrics.Metrics{ID: "Alloc", MType: storage.Gauge, Value: &value})
+		require.NoError(t, err)
+	}
+
+	policy, err := storage.ParseRetentionPolicy("raw:10m,1m:1h")
+	require.NoError(t, err)
+	require.NoError(t, storage.NewCompactor(s, policy).Compact(ctx, start.Add(2*time.Minute)))
+	require.NoError(t, storage.NewCompactor(s, policy).Compact(ctx, start.Add(15*time.Minute)))
+
+	samples, err := s.QueryRange(ctx, storage.Gauge, "Alloc", nil, start.Add(-time.Minute), time.Now())
+	require.NoError(t, err)
+	assert.Empty(t, samples)
+
+	rollups, err := s.QueryRollups(ctx, storage.Gauge, "Alloc", nil, time.Minute, start.Add(-time.Minute), start.Add(time.Minute))
+	require.NoError(t, err)
+	require.NotEmpty(t, rollups)
+	var count int64
+	for _, r := range rollups {
+		count += r.Count
+	}
+	assert.Equal(t, int64(3), count)
+	assert.Equal(t, 2.0, rollups[len(rollups)-1].Last)
+
+	require.NoError(t, s.DeleteMetric(ctx, storage.Gauge, "Alloc", nil))
+	_, err = s.QueryRollups(ctx, storage.Gauge, "Alloc", nil, time.Minute, start.Add(-time.Minute), start.Add(time.Minute))
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+}
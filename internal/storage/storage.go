@@ -1,107 +1,391 @@
 package storage
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/eugeniylennik/alertics/internal/metrics"
-	"github.com/eugeniylennik/alertics/internal/storage/file"
-	"log"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 const Gauge = "gauge"
 const Counter = "counter"
+const Histogram = "histogram"
 
-type MemStorage struct {
-	mux           sync.Mutex
-	gauge         map[string]float64
-	counter       map[string]int64
-	isStoreToFile bool
-	writer        *file.Writer
+var (
+	ErrNotFound        = errors.New("metric not found")
+	ErrInvalidType     = errors.New("invalid metric type")
+	ErrEmptyValue      = errors.New("metric value is empty")
+	ErrInvalidID       = errors.New("metric id must not contain '{'")
+	ErrAmbiguousSeries = errors.New("labels match several series")
+)
+
+// Repository is implemented by every storage backend the server can run on.
+// A series is identified by its type, id and labels; nil and empty labels
+// are the same series.
+type Repository interface {
+	GetMetric(ctx context.Context, mType, id string, labels metrics.Labels) (metrics.Metrics, error)
+	UpsertMetric(ctx context.Context, m metrics.Metrics) (metrics.Metrics, error)
+	UpsertMetrics(ctx context.Context, m []metrics.Metrics) ([]metrics.Metrics, error)
+	ListMetrics(ctx context.Context) ([]metrics.Metrics, error)
+	DeleteMetric(ctx context.Context, mType, id string, labels metrics.Labels) error
+	QueryRange(ctx context.Context, mType, id string, labels metrics.Labels, from, to time.Time) ([]Sample, error)
+	Ping(ctx context.Context) error
 }
 
-func NewMemStorage(fileName string, isStoreToFile bool) *MemStorage {
-	w, err := file.NewWriter(fileName)
+// Unwrapper is implemented by repositories decorating another repository.
+type Unwrapper interface {
+	Unwrap() Repository
+}
+
+// As walks the chain of decorated repositories and returns the first one
+// implementing T, e.g. storage.As[storage.RollupStore](repo).
+func As[T any](repo Repository) (T, bool) {
+	for repo != nil {
+		if v, ok := repo.(T); ok {
+			return v, true
+		}
+		u, ok := repo.(Unwrapper)
+		if !ok {
+			break
+		}
+		repo = u.Unwrap()
+	}
+	var zero T
+	return zero, false
+}
+
+// Validate checks that m has a known type, carries the matching value and has
+// valid labels. Ids must not contain '{', which starts the labels of a series
+// name such as Alloc{host="a"}.
+func Validate(m metrics.Metrics) error {
+	if strings.ContainsRune(m.ID, '{') {
+		return ErrInvalidID
+	}
+	if err := m.Labels.Validate(); err != nil {
+		return err
+	}
+	switch m.MType {
+	case Gauge:
+		if m.Value == nil {
+			return ErrEmptyValue
+		}
+	case Counter:
+		if m.Delta == nil {
+			return ErrEmptyValue
+		}
+	case Histogram:
+		if m.Histogram == nil {
+			return ErrEmptyValue
+		}
+		return m.Histogram.Validate()
+	default:
+		return ErrInvalidType
+	}
+	return nil
+}
+
+// FindMetric returns the series of type mType and id whose labels match
+// matchers. A series with exactly the matcher labels is preferred, otherwise
+// the matchers must select a single series.
+func FindMetric(ctx context.Context, repo Repository, mType, id string, matchers metrics.Labels) (metrics.Metrics, error) {
+	m, err := repo.GetMetric(ctx, mType, id, matchers)
+	if !errors.Is(err, ErrNotFound) {
+		return m, err
+	}
+
+	all, err := repo.ListMetrics(ctx)
 	if err != nil {
-		log.Println(err)
+		return metrics.Metrics{}, err
+	}
+	matched := FilterMetrics(all, matchers)
+	found := 0
+	for _, v := range matched {
+		if v.MType == mType && v.ID == id {
+			m = v
+			found++
+		}
+	}
+	switch found {
+	case 0:
+		return metrics.Metrics{}, ErrNotFound
+	case 1:
+		return m, nil
+	default:
+		return metrics.Metrics{}, ErrAmbiguousSeries
+	}
+}
+
+// FilterMetrics returns the metrics whose labels match matchers.
+func FilterMetrics(m []metrics.Metrics, matchers metrics.Labels) []metrics.Metrics {
+	if len(matchers) == 0 {
+		return m
+	}
+	var result []metrics.Metrics
+	for _, v := range m {
+		if v.Labels.Matches(matchers) {
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+type MemStorage struct {
+	mux         sync.RWMutex
+	gauge       map[seriesKey]float64
+	counter     map[seriesKey]int64
+	histogram   map[seriesKey]*metrics.Histogram
+	history     map[seriesKey]*ring
+	historySize int
+	rollups     map[rollupKey]map[int64]Rollup
+	silences    map[string]Silence
+}
+
+// NewMemStorage creates an in-memory storage keeping the last historySize
+// samples of every series.
+func NewMemStorage(historySize int) *MemStorage {
+	if historySize <= 0 {
+		historySize = DefaultHistorySize
 	}
 	return &MemStorage{
-		gauge:         map[string]float64{},
-		counter:       map[string]int64{},
-		isStoreToFile: isStoreToFile,
-		writer:        w,
+		gauge:       map[seriesKey]float64{},
+		counter:     map[seriesKey]int64{},
+		histogram:   map[seriesKey]*metrics.Histogram{},
+		history:     map[seriesKey]*ring{},
+		historySize: historySize,
+		rollups:     map[rollupKey]map[int64]Rollup{},
+		silences:    map[string]Silence{},
 	}
 }
 
-func (ms *MemStorage) AddGauge(m metrics.Data) error {
+func (ms *MemStorage) GetMetric(_ context.Context, mType, id string, labels metrics.Labels) (metrics.Metrics, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+	return ms.get(newSeriesKey(mType, id, labels))
+}
+
+func (ms *MemStorage) UpsertMetric(_ context.Context, m metrics.Metrics) (metrics.Metrics, error) {
+	ms.mux.Lock()
+	defer ms.mux.Unlock()
+	return ms.upsert(m)
+}
+
+func (ms *MemStorage) UpsertMetrics(_ context.Context, m []metrics.Metrics) ([]metrics.Metrics, error) {
+	for _, v := range m {
+		if err := Validate(v); err != nil {
+			return nil, fmt.Errorf("metric %s: %w", v.ID, err)
+		}
+	}
+
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
-	if m.Type == Gauge {
-		ms.gauge[m.Name] = m.Value
-	} else {
-		return errors.New("invalid metric type")
+
+	// Nothing is stored if a histogram cannot be merged.
+	buckets := map[seriesKey]*metrics.Histogram{}
+	for _, v := range m {
+		if v.MType != Histogram {
+			continue
+		}
+		key := newSeriesKey(v.MType, v.ID, v.Labels)
+		prev, ok := buckets[key]
+		if !ok {
+			prev, ok = ms.histogram[key]
+		}
+		if ok {
+			if _, err := prev.Merge(v.Histogram); err != nil {
+				return nil, fmt.Errorf("metric %s: %w", v.ID, err)
+			}
+		}
+		buckets[key] = v.Histogram
 	}
-	if ms.isStoreToFile {
-		b, _ := json.Marshal(m)
-		if err := ms.writer.WriteMetrics(b); err != nil {
-			log.Println(err)
+
+	result := make([]metrics.Metrics, 0, len(m))
+	for _, v := range m {
+		r, err := ms.upsert(v)
+		if err != nil {
+			return nil, err
 		}
+		result = append(result, r)
 	}
-	return nil
+	return result, nil
 }
 
-func (ms *MemStorage) AddCounter(m metrics.Data) error {
+func (ms *MemStorage) ListMetrics(_ context.Context) ([]metrics.Metrics, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+
+	result := make([]metrics.Metrics, 0, len(ms.gauge)+len(ms.counter)+len(ms.histogram))
+	for k := range ms.gauge {
+		m, _ := ms.get(k)
+		result = append(result, m)
+	}
+	for k := range ms.counter {
+		m, _ := ms.get(k)
+		result = append(result, m)
+	}
+	for k := range ms.histogram {
+		m, _ := ms.get(k)
+		result = append(result, m)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].MType != result[j].MType {
+			return result[i].MType < result[j].MType
+		}
+		if result[i].ID != result[j].ID {
+			return result[i].ID < result[j].ID
+		}
+		return result[i].Labels.String() < result[j].Labels.String()
+	})
+	return result, nil
+}
+
+func (ms *MemStorage) DeleteMetric(_ context.Context, mType, id string, labels metrics.Labels) error {
 	ms.mux.Lock()
 	defer ms.mux.Unlock()
-	if m.Type == Counter {
-		ms.counter[m.Name] += int64(m.Value)
-	} else {
-		return errors.New("invalid metric type")
+
+	key := newSeriesKey(mType, id, labels)
+	switch mType {
+	case Gauge:
+		if _, ok := ms.gauge[key]; !ok {
+			return ErrNotFound
+		}
+		delete(ms.gauge, key)
+	case Counter:
+		if _, ok := ms.counter[key]; !ok {
+			return ErrNotFound
+		}
+		delete(ms.counter, key)
+	case Histogram:
+		if _, ok := ms.histogram[key]; !ok {
+			return ErrNotFound
+		}
+		delete(ms.histogram, key)
+	default:
+		return ErrInvalidType
 	}
-	if ms.isStoreToFile {
-		b, _ := json.Marshal(m)
-		if err := ms.writer.WriteMetrics(b); err != nil {
-			log.Println(err)
+	delete(ms.history, key)
+	for k := range ms.rollups {
+		if k.seriesKey == key {
+			delete(ms.rollups, k)
 		}
 	}
 	return nil
 }
 
-func (ms *MemStorage) GetGauge(name string) (float64, error) {
-	v, ok := ms.gauge[name]
+func (ms *MemStorage) QueryRange(_ context.Context, mType, id string, labels metrics.Labels, from, to time.Time) ([]Sample, error) {
+	ms.mux.RLock()
+	defer ms.mux.RUnlock()
+
+	key := newSeriesKey(mType, id, labels)
+	if _, err := ms.get(key); err != nil {
+		return nil, err
+	}
+	h, ok := ms.history[key]
 	if !ok {
-		return 0, fmt.Errorf("metric %s not found", name)
+		return nil, nil
 	}
-	return v, nil
+	return h.between(from, to), nil
 }
 
-func (ms *MemStorage) GetCounter(name string) (int64, error) {
-	v, ok := ms.counter[name]
-	if !ok {
-		return 0, fmt.Errorf("metric %s not found", name)
+func (ms *MemStorage) Ping(_ context.Context) error {
+	return nil
+}
+
+func (ms *MemStorage) get(key seriesKey) (metrics.Metrics, error) {
+	m := metrics.Metrics{ID: key.id, MType: key.mType}
+	switch key.mType {
+	case Gauge:
+		v, ok := ms.gauge[key]
+		if !ok {
+			return metrics.Metrics{}, ErrNotFound
+		}
+		m.Value = &v
+	case Counter:
+		v, ok := ms.counter[key]
+		if !ok {
+			return metrics.Metrics{}, ErrNotFound
+		}
+		m.Delta = &v
+	case Histogram:
+		v, ok := ms.histogram[key]
+		if !ok {
+			return metrics.Metrics{}, ErrNotFound
+		}
+		m.Histogram = v.Clone()
+	default:
+		return metrics.Metrics{}, ErrInvalidType
 	}
-	return v, nil
+	// The key holds the canonical form, which always parses.
+	m.Labels, _ = metrics.ParseLabels(key.labels)
+	return m, nil
 }
 
-func (ms *MemStorage) GetAllMetrics() ([]byte, error) {
-	m := &MemStorage{
-		gauge:   map[string]float64{},
-		counter: map[string]int64{},
+func (ms *MemStorage) upsert(m metrics.Metrics) (metrics.Metrics, error) {
+	if err := Validate(m); err != nil {
+		return metrics.Metrics{}, err
+	}
+	key := newSeriesKey(m.MType, m.ID, m.Labels)
+	switch m.MType {
+	case Gauge:
+		ms.gauge[key] = *m.Value
+	case Counter:
+		ms.counter[key] += *m.Delta
+	case Histogram:
+		h := m.Histogram.Clone()
+		if prev, ok := ms.histogram[key]; ok {
+			var err error
+			if h, err = prev.Merge(m.Histogram); err != nil {
+				return metrics.Metrics{}, err
+			}
+		}
+		ms.histogram[key] = h
+	}
+	r, err := ms.get(key)
+	if err != nil {
+		return metrics.Metrics{}, err
 	}
-	for k, v := range ms.gauge {
-		m.gauge[k] = v
+
+	h, ok := ms.history[key]
+	if !ok {
+		h = newRing(ms.historySize)
+		ms.history[key] = h
 	}
-	for k, v := range ms.counter {
-		m.counter[k] = v
+	h.push(NewSample(time.Now(), r))
+	return r, nil
+}
+
+// MarshalMetrics encodes m into the {"Gauge": {...}, "Counter": {...}} document
+// served on GET / and written to the store file. Labeled series are keyed by
+// the id followed by the canonical labels, e.g. Alloc{host="a"}. Histograms
+// are listed under "Histogram" when there are any.
+func MarshalMetrics(m []metrics.Metrics) ([]byte, error) {
+	gauge := map[string]float64{}
+	counter := map[string]int64{}
+	histogram := map[string]*metrics.Histogram{}
+	for _, v := range m {
+		name := v.ID + v.Labels.String()
+		switch v.MType {
+		case Gauge:
+			gauge[name] = *v.Value
+		case Counter:
+			counter[name] = *v.Delta
+		case Histogram:
+			histogram[name] = v.Histogram
+		}
 	}
 
 	b, err := json.Marshal(struct {
-		Gauge   map[string]float64
-		Counter map[string]int64
+		Gauge     map[string]float64
+		Counter   map[string]int64
+		Histogram map[string]*metrics.Histogram `json:",omitempty"`
 	}{
-		Gauge:   m.gauge,
-		Counter: m.counter,
+		Gauge:     gauge,
+		Counter:   counter,
+		Histogram: histogram,
 	})
 	if err != nil {
 		return nil, err
@@ -0,0 +1,31 @@
+package telemetry
+
+var (
+	HTTPRequests = Default.NewCounter(
+		Prefix+"http_requests_total",
+		"Number of HTTP requests by route, method and status.",
+		"route", "method", "status")
+	HTTPRequestDuration = Default.NewHistogram(
+		Prefix+"http_request_duration_seconds",
+		"HTTP request latencies by route and method.",
+		DefaultBuckets, "route", "method")
+	BatchSize = Default.NewHistogram(
+		Prefix+"updates_batch_size",
+		"Number of metrics per /updates request.",
+		[]float64{1, 5, 10, 25, 50, 100, 250, 500, 1000})
+	StorageOperationDuration = Default.NewHistogram(
+		Prefix+"storage_operation_duration_seconds",
+		"Storage operation latencies by operation.",
+		DefaultBuckets, "operation")
+	StorageOperationErrors = Default.NewCounter(
+		Prefix+"storage_operation_errors_total",
+		"Number of failed storage operations by operation.",
+		"operation")
+	HashVerificationFailures = Default.NewCounter(
+		Prefix+"hash_verification_failures_total",
+		"Number of metrics rejected or flagged because of a missing or invalid hash.")
+	FileDumpDuration = Default.NewHistogram(
+		Prefix+"file_dump_duration_seconds",
+		"Time spent dumping metrics to the store file.",
+		DefaultBuckets)
+)
@@ -0,0 +1,80 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"time"
+)
+
+// repository records the latency and the errors of every storage operation.
+type repository struct {
+	storage.Repository
+}
+
+// InstrumentRepository wraps repo to record storage metrics. Optional
+// interfaces of repo are reachable through storage.As.
+func InstrumentRepository(repo storage.Repository) storage.Repository {
+	return &repository{repo}
+}
+
+func (r *repository) Unwrap() storage.Repository {
+	return r.Repository
+}
+
+func observe(operation string, start time.Time, err error) {
+	StorageOperationDuration.Observe(time.Since(start).Seconds(), operation)
+	if err != nil && !errors.Is(err, storage.ErrNotFound) {
+		StorageOperationErrors.Inc(operation)
+	}
+}
+
+func (r *repository) GetMetric(ctx context.Context, mType, id string, labels metrics.Labels) (metrics.Metrics, error) {
+	start := time.Now()
+	result, err := r.Repository.GetMetric(ctx, mType, id, labels)
+	observe("get", start, err)
+	return result, err
+}
+
+func (r *repository) UpsertMetric(ctx context.Context, m metrics.Metrics) (metrics.Metrics, error) {
+	start := time.Now()
+	result, err := r.Repository.UpsertMetric(ctx, m)
+	observe("upsert", start, err)
+	return result, err
+}
+
+func (r *repository) UpsertMetrics(ctx context.Context, m []metrics.Metrics) ([]metrics.Metrics, error) {
+	start := time.Now()
+	result, err := r.Repository.UpsertMetrics(ctx, m)
+	observe("upsert_batch", start, err)
+	return result, err
+}
+
+func (r *repository) ListMetrics(ctx context.Context) ([]metrics.Metrics, error) {
+	start := time.Now()
+	result, err := r.Repository.ListMetrics(ctx)
+	observe("list", start, err)
+	return result, err
+}
+
+func (r *repository) DeleteMetric(ctx context.Context, mType, id string, labels metrics.Labels) error {
+	start := time.Now()
+	err := r.Repository.DeleteMetric(ctx, mType, id, labels)
+	observe("delete", start, err)
+	return err
+}
+
+func (r *repository) QueryRange(ctx context.Context, mType, id string, labels metrics.Labels, from, to time.Time) ([]storage.Sample, error) {
+	start := time.Now()
+	result, err := r.Repository.QueryRange(ctx, mType, id, labels, from, to)
+	observe("query_range", start, err)
+	return result, err
+}
+
+func (r *repository) Ping(ctx context.Context) error {
+	start := time.Now()
+	err := r.Repository.Ping(ctx)
+	observe("ping", start, err)
+	return err
+}
@@ -0,0 +1,165 @@
+package telemetry
+
+import (
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/prometheus"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Prefix is reserved for the metrics the server records about itself.
+const Prefix = "alertics_"
+
+// DefaultBuckets are latency buckets in seconds.
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	family() prometheus.Family
+}
+
+// Registry holds the server self-metrics.
+type Registry struct {
+	mux        sync.Mutex
+	collectors []collector
+}
+
+var Default = &Registry{}
+
+func (r *Registry) register(c collector) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// Gather returns the current values of all registered metrics.
+func (r *Registry) Gather() []prometheus.Family {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	result := make([]prometheus.Family, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		if f := c.family(); len(f.Samples) > 0 {
+			result = append(result, f)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	histogram   *metrics.Histogram
+}
+
+type vec struct {
+	mux        sync.Mutex
+	name       string
+	help       string
+	labelNames []string
+	series     map[string]*series
+}
+
+func (v *vec) get(labelValues []string) *series {
+	key := strings.Join(labelValues, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string(nil), labelValues...)}
+		v.series[key] = s
+	}
+	return s
+}
+
+func (v *vec) labels(labelValues []string) map[string]string {
+	if len(v.labelNames) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(v.labelNames))
+	for i, name := range v.labelNames {
+		labels[name] = labelValues[i]
+	}
+	return labels
+}
+
+func (v *vec) sorted() []*series {
+	result := make([]*series, 0, len(v.series))
+	for _, s := range v.series {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return strings.Join(result[i].labelValues, "\xff") < strings.Join(result[j].labelValues, "\xff")
+	})
+	return result
+}
+
+// Counter is a monotonically increasing value per label set.
+type Counter struct {
+	vec
+}
+
+func (r *Registry) NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{vec{name: name, help: help, labelNames: labelNames, series: map[string]*series{}}}
+	r.register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.get(labelValues).value += delta
+}
+
+func (c *Counter) family() prometheus.Family {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	f := prometheus.Family{Name: c.name, Type: "counter", Help: c.help}
+	for _, s := range c.sorted() {
+		f.Samples = append(f.Samples, prometheus.Sample{Labels: c.labels(s.labelValues), Value: s.value})
+	}
+	return f
+}
+
+// Histogram counts observations into cumulative buckets per label set.
+type Histogram struct {
+	vec
+	buckets []float64
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{
+		vec:     vec{name: name, help: help, labelNames: labelNames, series: map[string]*series{}},
+		buckets: buckets,
+	}
+	r.register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	s := h.get(labelValues)
+	if s.histogram == nil {
+		s.histogram = metrics.NewHistogram(h.buckets)
+	}
+	s.histogram.Observe(v)
+}
+
+func (h *Histogram) family() prometheus.Family {
+	h.mux.Lock()
+	defer h.mux.Unlock()
+
+	f := prometheus.Family{Name: h.name, Type: "histogram", Help: h.help}
+	for _, s := range h.sorted() {
+		f.Samples = append(f.Samples, prometheus.HistogramSamples(h.labels(s.labelValues), s.histogram)...)
+	}
+	return f
+}
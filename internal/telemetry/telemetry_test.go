@@ -0,0 +1,99 @@
+package telemetry_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/eugeniylennik/alertics/internal/metrics"
+	"github.com/eugeniylennik/alertics/internal/prometheus"
+	"github.com/eugeniylennik/alertics/internal/storage"
+	"github.com/eugeniylennik/alertics/internal/telemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func TestRegistry_Gather(t *testing.T) {
+	r := &telemetry.Registry{}
+	requests := r.NewCounter("test_requests_total", "Number of requests.", "route", "status")
+	duration := r.NewHistogram("test_duration_seconds", "Request latencies.", []float64{0.1, 1}, "route")
+	r.NewCounter("test_unused_total", "Never incremented.")
+
+	requests.Inc("/update", "200")
+	requests.Add(2, "/update", "200")
+	requests.Inc("/ping", "500")
+	duration.Observe(0.05, "/update")
+	duration.Observe(0.5, "/update")
+	duration.Observe(5, "/update")
+
+	var buf bytes.Buffer
+	require.NoError(t, prometheus.Write(&buf, r.Gather()))
+	assert.Equal(t, `# HELP test_duration_seconds Request latencies.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{le="0.1",route="/update"} 1
+test_duration_seconds_bucket{le="1",route="/update"} 2
+test_duration_seconds_bucket{le="+Inf",route="/update"} 3
+test_duration_seconds_sum{route="/update"} 5.55
+test_duration_seconds_count{route="/update"} 3
+# HELP test_requests_total Number of requests.
+# TYPE test_requests_total counter
+test_requests_total{route="/ping",status="500"} 1
+test_requests_total{route="/update",status="200"} 3
+`, buf.String())
+}
+
+var errBroken = errors.New("broken")
+
+// brokenRepository fails every upsert.
+type brokenRepository struct {
+	*storage.MemStorage
+}
+
+func (r brokenRepository) UpsertMetric(context.Context, metrics.Metrics) (metrics.Metrics, error) {
+	return metrics.Metrics{}, errBroken
+}
+
+// operationErrors returns the failures recorded for operation.
+func operationErrors(operation string) float64 {
+	for _, f := range telemetry.Default.Gather() {
+		if f.Name != telemetry.Prefix+"storage_operation_errors_total" {
+			continue
+		}
+		for _, s := range f.Samples {
+			if s.Labels["operation"] == operation {
+				return s.Value
+			}
+		}
+	}
+	return 0
+}
+
+func TestInstrumentRepository(t *testing.T) {
+	ctx := context.Background()
+	mem := storage.NewMemStorage(storage.DefaultHistorySize)
+	repo := telemetry.InstrumentRepository(brokenRepository{mem})
+
+	upserts, gets := operationErrors("upsert"), operationErrors("get")
+
+	value := 1.5
+	_, err := repo.UpsertMetric(ctx, metrics.Metrics{ID: "Alloc", MType: storage.Gauge, Value: &value})
+	assert.ErrorIs(t, err, errBroken)
+	assert.Equal(t, upserts+1, operationErrors("upsert"))
+
+	// Missing metrics are not failures.
+	_, err = repo.GetMetric(ctx, storage.Gauge, "Alloc", nil)
+	assert.ErrorIs(t, err, storage.ErrNotFound)
+	assert.Equal(t, gets, operationErrors("get"))
+
+	u, ok := repo.(storage.Unwrapper)
+	require.True(t, ok)
+	assert.Equal(t, brokenRepository{mem}, u.Unwrap())
+
+	silences, ok := storage.As[storage.SilenceRepository](repo)
+	require.True(t, ok)
+	assert.Same(t, mem, silences.(brokenRepository).MemStorage)
+
+	rs, ok := storage.As[storage.RollupStore](repo)
+	require.True(t, ok)
+	assert.Equal(t, brokenRepository{mem}, rs)
+}
@@ -1,6 +1,9 @@
 package utils
 
-import "time"
+import (
+	"context"
+	"time"
+)
 
 func RetryConnectToDataBase(fn func() error, maxAttempts int, delay time.Duration) (err error) {
 	for maxAttempts > 0 {
@@ -13,3 +16,32 @@ func RetryConnectToDataBase(fn func() error, maxAttempts int, delay time.Duratio
 	}
 	return
 }
+
+// RetryWithBackoff calls fn up to maxAttempts times, doubling the delay after
+// every failure starting from baseDelay and capping it at maxDelay. It stops
+// early when ctx is done and returns the last error.
+func RetryWithBackoff(ctx context.Context, fn func() error, maxAttempts int, baseDelay, maxDelay time.Duration) (err error) {
+	delay := baseDelay
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt == maxAttempts {
+			break
+		}
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		}
+
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+	}
+	return
+}